@@ -0,0 +1,88 @@
+package main
+
+import (
+	"github.com/dylhunn/dragontoothmg"
+)
+
+// Static evaluation correction history
+// Learns the difference between search scores and the static eval for positions sharing the same
+// pawn structure, material or non-pawn pieces, and uses it to correct the static eval used for pruning.
+
+const CORRHIST_SIZE = 16384
+const CORRHIST_GRAIN = 256 // Entries are stored scaled by this factor, for more precision
+const CORRHIST_WEIGHT_SCALE = 256
+const CORRHIST_MAX = CORRHIST_GRAIN * 32
+
+// Each table learns the whole difference, so the correction is their weighted average
+const PAWN_CORRHIST_WEIGHT = 1
+const MATERIAL_CORRHIST_WEIGHT = 1
+const NON_PAWN_CORRHIST_WEIGHT = 1 // for the average of the two non-pawn tables
+
+var PawnCorrHist [2][CORRHIST_SIZE]int       // indexed by [side to move][pawn key]
+var MaterialCorrHist [2][CORRHIST_SIZE]int   // indexed by [side to move][material key]
+var NonPawnCorrHist [2][2][CORRHIST_SIZE]int // indexed by [side to move][color][non-pawn key of this color]
+
+func ClearCorrectionHistory() {
+	PawnCorrHist = [2][CORRHIST_SIZE]int{}
+	MaterialCorrHist = [2][CORRHIST_SIZE]int{}
+	NonPawnCorrHist = [2][2][CORRHIST_SIZE]int{}
+}
+
+// Hashes a bitboard (splitmix64 finalizer), with a salt to get different keys for different piece types
+func MixBitboard(x uint64, salt uint64) uint64 {
+	x += 0x9E3779B97F4A7C15 * (salt + 1)
+	x = (x ^ (x >> 30)) * 0xBF58476D1CE4E5B9
+	x = (x ^ (x >> 27)) * 0x94D049BB133111EB
+	return x ^ (x >> 31)
+}
+
+func PawnKey(board *dragontoothmg.Board) uint64 {
+	return MixBitboard(board.White.Pawns, 0) ^ MixBitboard(board.Black.Pawns, 1)
+}
+
+func NonPawnKey(pieces *dragontoothmg.Bitboards) uint64 {
+	return MixBitboard(pieces.Knights, 2) ^ MixBitboard(pieces.Bishops, 3) ^ MixBitboard(pieces.Rooks, 4) ^
+		MixBitboard(pieces.Queens, 5) ^ MixBitboard(pieces.Kings, 6)
+}
+
+func MaterialKey(board *dragontoothmg.Board) uint64 {
+	key := uint64(0)
+	for _, pieces := range []*dragontoothmg.Bitboards{&board.White, &board.Black} {
+		for _, bitboard := range []uint64{pieces.Pawns, pieces.Knights, pieces.Bishops, pieces.Rooks, pieces.Queens} {
+			key = key<<4 | uint64(popcount(bitboard))
+		}
+	}
+	return MixBitboard(key, 7)
+}
+
+// Returns the static eval corrected with the correction history tables
+func CorrectEval(board *dragontoothmg.Board, raw_eval int) int {
+	stm := GetColor(board.Wtomove)
+	pawn := PawnCorrHist[stm][PawnKey(board)%CORRHIST_SIZE]
+	material := MaterialCorrHist[stm][MaterialKey(board)%CORRHIST_SIZE]
+	non_pawn := (NonPawnCorrHist[stm][WHITE][NonPawnKey(&board.White)%CORRHIST_SIZE] +
+		NonPawnCorrHist[stm][BLACK][NonPawnKey(&board.Black)%CORRHIST_SIZE]) / 2
+	correction := (PAWN_CORRHIST_WEIGHT*pawn + MATERIAL_CORRHIST_WEIGHT*material + NON_PAWN_CORRHIST_WEIGHT*non_pawn) /
+		(PAWN_CORRHIST_WEIGHT + MATERIAL_CORRHIST_WEIGHT + NON_PAWN_CORRHIST_WEIGHT)
+
+	corrected := raw_eval + correction/CORRHIST_GRAIN
+	return max(-MATE_SCORE+MAX_PLY+1, min(MATE_SCORE-MAX_PLY-1, corrected)) // don't create fake mate scores
+}
+
+func UpdateCorrHistEntry(entry *int, scaled_diff int, weight int) {
+	*entry = (*entry*(CORRHIST_WEIGHT_SCALE-weight) + scaled_diff*weight) / CORRHIST_WEIGHT_SCALE
+	*entry = max(-CORRHIST_MAX, min(CORRHIST_MAX, *entry))
+}
+
+// Moves the correction entries of the position towards the difference between the search score and the raw static eval,
+// with more weight for deeper searches
+func UpdateCorrectionHistory(board *dragontoothmg.Board, depth int, score int, raw_eval int) {
+	stm := GetColor(board.Wtomove)
+	scaled_diff := (score - raw_eval) * CORRHIST_GRAIN
+	weight := min(depth*depth+2*depth+1, 128)
+
+	UpdateCorrHistEntry(&PawnCorrHist[stm][PawnKey(board)%CORRHIST_SIZE], scaled_diff, weight)
+	UpdateCorrHistEntry(&MaterialCorrHist[stm][MaterialKey(board)%CORRHIST_SIZE], scaled_diff, weight)
+	UpdateCorrHistEntry(&NonPawnCorrHist[stm][WHITE][NonPawnKey(&board.White)%CORRHIST_SIZE], scaled_diff, weight)
+	UpdateCorrHistEntry(&NonPawnCorrHist[stm][BLACK][NonPawnKey(&board.Black)%CORRHIST_SIZE], scaled_diff, weight)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"github.com/dylhunn/dragontoothmg"
+)
+
+// Upcoming repetition detection, using the cuckoo tables algorithm by Marcel van Kervinck
+// (see http://web.archive.org/web/20201107002606/https://marcelk.net/2013-04-06/paper/upcoming-rep-v2.pdf)
+// The tables store the Zobrist key difference of every reversible move (of a non-pawn piece) on an empty board,
+// so that we can find in O(1) whether a single move separates the current position from a previous one.
+
+const CUCKOO_SIZE = 8192
+
+var CuckooKeys [CUCKOO_SIZE]uint64
+var CuckooMoves [CUCKOO_SIZE][2]uint8 // [from, to], a1a1 for empty slots
+
+var BetweenTable [64][64]uint64 // Squares strictly between two aligned squares
+
+func CuckooH1(key uint64) int {
+	return int(key & (CUCKOO_SIZE - 1))
+}
+
+func CuckooH2(key uint64) int {
+	return int((key >> 16) & (CUCKOO_SIZE - 1))
+}
+
+// Checks whether a piece can go from square_a to square_b on an empty board
+func PseudoAttacks(piece int, square_a uint8, square_b uint8) bool {
+	file_diff := abs(int(square_a%8) - int(square_b%8))
+	rank_diff := abs(int(square_a/8) - int(square_b/8))
+	diagonal := file_diff == rank_diff && file_diff != 0
+	straight := (file_diff == 0) != (rank_diff == 0)
+	switch piece {
+	case dragontoothmg.Knight:
+		return file_diff*rank_diff == 2
+	case dragontoothmg.Bishop:
+		return diagonal
+	case dragontoothmg.Rook:
+		return straight
+	case dragontoothmg.Queen:
+		return diagonal || straight
+	case dragontoothmg.King:
+		return max(file_diff, rank_diff) == 1
+	}
+	return false
+}
+
+// Builds a FEN from a board given as an array of piece characters (0 for an empty square)
+func PlacementToFen(squares [64]byte, w_to_move bool) string {
+	fen := ""
+	for rank := 7; rank >= 0; rank-- {
+		empty := 0
+		for file := 0; file < 8; file++ {
+			c := squares[rank*8+file]
+			if c == 0 {
+				empty++
+				continue
+			}
+			if empty != 0 {
+				fen += string(rune('0' + empty))
+				empty = 0
+			}
+			fen += string(c)
+		}
+		if empty != 0 {
+			fen += string(rune('0' + empty))
+		}
+		if rank != 0 {
+			fen += "/"
+		}
+	}
+	if w_to_move {
+		return fen + " w - - 0 1"
+	}
+	return fen + " b - - 0 1"
+}
+
+// Computes the Zobrist key difference of a move (piece moved + side to move changed), with the keys used
+// by dragontoothmg, by hashing two positions which only differ by this move
+func MoveZobristKey(piece int, is_white bool, square_a uint8, square_b uint8) uint64 {
+	piece_char := " pnbrqk"[piece]
+	if is_white {
+		piece_char -= 'a' - 'A'
+	}
+
+	var before, after [64]byte
+	before[square_a] = piece_char
+	after[square_b] = piece_char
+
+	// Add the kings which aren't moving on free squares, they cancel out in the difference
+	for _, king := range []byte{'K', 'k'} {
+		if piece == dragontoothmg.King && king == piece_char {
+			continue
+		}
+		for square := uint8(0); square < 64; square++ {
+			if before[square] == 0 && after[square] == 0 && square != square_a && square != square_b {
+				before[square], after[square] = king, king
+				break
+			}
+		}
+	}
+
+	board_before := dragontoothmg.ParseFen(PlacementToFen(before, is_white))
+	board_after := dragontoothmg.ParseFen(PlacementToFen(after, !is_white))
+	return board_before.Hash() ^ board_after.Hash()
+}
+
+func InitCuckooTables() {
+	for square_a := uint8(0); square_a < 64; square_a++ {
+		for square_b := uint8(0); square_b < 64; square_b++ {
+			BetweenTable[square_a][square_b] = 0
+			if square_a == square_b || !PseudoAttacks(dragontoothmg.Queen, square_a, square_b) {
+				continue
+			}
+			file_step := sign(int(square_b%8) - int(square_a%8))
+			rank_step := sign(int(square_b/8) - int(square_a/8))
+			step := rank_step*8 + file_step
+			for square := int(square_a) + step; square != int(square_b); square += step {
+				BetweenTable[square_a][square_b] |= uint64(1) << square
+			}
+		}
+	}
+
+	CuckooKeys = [CUCKOO_SIZE]uint64{}
+	CuckooMoves = [CUCKOO_SIZE][2]uint8{}
+	for _, is_white := range []bool{true, false} {
+		for piece := dragontoothmg.Knight; piece <= dragontoothmg.King; piece++ {
+			for square_a := uint8(0); square_a < 64; square_a++ {
+				for square_b := square_a + 1; square_b < 64; square_b++ {
+					if !PseudoAttacks(piece, square_a, square_b) {
+						continue
+					}
+					key := MoveZobristKey(piece, is_white, square_a, square_b)
+					move := [2]uint8{square_a, square_b}
+
+					// Cuckoo insertion: kick out the previous entry to its other slot until an empty one is found
+					i := CuckooH1(key)
+					for {
+						CuckooKeys[i], key = key, CuckooKeys[i]
+						CuckooMoves[i], move = move, CuckooMoves[i]
+						if move == [2]uint8{} {
+							break
+						}
+						if i == CuckooH1(key) {
+							i = CuckooH2(key)
+						} else {
+							i = CuckooH1(key)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func sign(x int) int {
+	if x > 0 {
+		return 1
+	} else if x < 0 {
+		return -1
+	}
+	return 0
+}
+
+// Checks whether the side to move can reach a previous position with a single reversible move
+// (that is, whether it can force a repetition or at least a cycle).
+func HasUpcomingRepetition(board *dragontoothmg.Board, ply int) bool {
+	last := len(HashHistory)
+	end := min(int(board.Halfmoveclock), last-HistoryFloor())
+	if end < 3 {
+		return false
+	}
+
+	hash := board.Hash()
+	occupied := board.White.All | board.Black.All
+	for i := 3; i <= end; i += 2 {
+		prev_hash := HashHistory[last-i]
+		move_key := hash ^ prev_hash
+
+		j := CuckooH1(move_key)
+		if CuckooKeys[j] != move_key {
+			j = CuckooH2(move_key)
+			if CuckooKeys[j] != move_key {
+				continue
+			}
+		}
+
+		square_a, square_b := CuckooMoves[j][0], CuckooMoves[j][1]
+		if BetweenTable[square_a][square_b]&occupied != 0 {
+			continue // the path of the move is blocked
+		}
+
+		if ply > i {
+			return true // the cycle is inside the search tree
+		}
+
+		// For positions before the root, the move has to be ours, and the position
+		// we go back to must already have been repeated
+		moving_square := square_a
+		if occupied&(uint64(1)<<square_a) == 0 {
+			moving_square = square_b
+		}
+		_, is_white := dragontoothmg.GetPieceType(moving_square, board)
+		if is_white != board.Wtomove {
+			continue
+		}
+		for k := last - i - 4; k >= max(HistoryFloor(), last-int(board.Halfmoveclock)); k -= 2 {
+			if HashHistory[k] == prev_hash {
+				return true
+			}
+		}
+	}
+	return false
+}
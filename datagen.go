@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dylhunn/dragontoothmg"
+)
+
+// Self-play data generation
+// The search uses global state, so each worker goroutine plays its games against an engine process of its own
+// (this executable, in UCI mode), with fixed-node searches. The positions are written in the text format of bullet:
+// `<fen> | <score> | <result>`, with the score (in cp) and the result (1.0, 0.5 or 0.0) from white's point of view.
+
+const MAX_OPENING_SCORE = 1000   // Openings whose first search is over this score (in cp) are discarded
+const MAX_GAME_PLIES = 500       // Games which are still running after this number of plies are adjudicated as draws
+const MAX_OPENING_ATTEMPTS = 100 // Number of openings tried for a game before giving up
+
+type DatagenOptions struct {
+	Games       int    // Number of games to play
+	Nodes       int    // Nodes per search
+	Threads     int    // Number of games played in parallel
+	RandomPlies int    // Number of random plies played from the starting position of each game
+	Book        string // EPD file of starting positions (the standard starting position is used if empty)
+	Hash        int    // Transposition table size of each engine (in MB)
+	Seed        int64
+}
+
+type DatagenEngine struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Scanner
+}
+
+// Starts an engine process, with the same network as this process
+func StartDatagenEngine(hash_size int) (*DatagenEngine, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	args := []string{}
+	if EvalFile != "" {
+		args = append(args, "-evalfile", EvalFile)
+	}
+	engine := &DatagenEngine{cmd: exec.Command(executable, args...)}
+	if engine.stdin, err = engine.cmd.StdinPipe(); err != nil {
+		return nil, err
+	}
+	stdout, err := engine.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	engine.stdout = bufio.NewScanner(stdout)
+	engine.cmd.Stderr = os.Stderr
+	if err := engine.cmd.Start(); err != nil {
+		return nil, err
+	}
+	engine.Send(fmt.Sprintf("setoption name Hash value %v", hash_size))
+	return engine, engine.WaitReady()
+}
+
+func (e *DatagenEngine) Send(command string) {
+	fmt.Fprintln(e.stdin, command)
+}
+
+func (e *DatagenEngine) WaitReady() error {
+	e.Send("isready")
+	for e.stdout.Scan() {
+		if e.stdout.Text() == "readyok" {
+			return nil
+		}
+	}
+	return errors.New("the engine process stopped")
+}
+
+func (e *DatagenEngine) NewGame() error {
+	e.Send("ucinewgame")
+	return e.WaitReady()
+}
+
+// Searches a position, and returns the best move and the score (from the point of view of the side to move)
+// of the last completed iteration. has_score is false if no iteration was completed (e.g. with a single legal move).
+func (e *DatagenEngine) Search(position string, nodes int) (move string, score int, is_mate bool, has_score bool, err error) {
+	e.Send(position)
+	e.Send(fmt.Sprintf("go nodes %v", nodes))
+	for e.stdout.Scan() {
+		fields := strings.Fields(e.stdout.Text())
+		if len(fields) >= 2 && fields[0] == "bestmove" {
+			return fields[1], score, is_mate, has_score, nil
+		}
+		if len(fields) == 0 || fields[0] != "info" {
+			continue
+		}
+		for i := 1; i+2 < len(fields); i++ {
+			if fields[i] == "score" {
+				score, _ = strconv.Atoi(fields[i+2])
+				is_mate = fields[i+1] == "mate"
+				has_score = true
+			}
+		}
+	}
+	return "", 0, false, false, errors.New("the engine process stopped")
+}
+
+func (e *DatagenEngine) Close() {
+	e.Send("quit")
+	e.cmd.Wait()
+}
+
+// Reads the positions of an EPD file (only the first 4 fields are used)
+func LoadEPDBook(filename string) ([]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	positions := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("invalid EPD line %q", scanner.Text())
+		}
+		positions = append(positions, strings.Join(fields[:4], " ")+" 0 1")
+	}
+	if len(positions) == 0 {
+		return nil, errors.New("no positions in the book")
+	}
+	return positions, scanner.Err()
+}
+
+// Plays random plies from a starting position, returns the FEN of the opening (or false if the game ended)
+func RandomOpening(start_fen string, random_plies int, rng *rand.Rand) (string, bool) {
+	board := dragontoothmg.ParseFen(start_fen)
+	for i := 0; i < random_plies; i++ {
+		legal_moves := board.GenerateLegalMoves()
+		if len(legal_moves) == 0 {
+			return "", false
+		}
+		board.Apply(legal_moves[rng.Intn(len(legal_moves))])
+	}
+	if len(board.GenerateLegalMoves()) == 0 {
+		return "", false
+	}
+	return board.ToFen(), true
+}
+
+// Plays a game from an opening, and returns the positions to keep (without the result) and the result of the game
+// from white's point of view. ok is false if the opening was discarded.
+func PlayDatagenGame(engine *DatagenEngine, opening string, nodes int) (positions []string, result string, ok bool, err error) {
+	if err := engine.NewGame(); err != nil {
+		return nil, "", false, err
+	}
+	board := dragontoothmg.ParseFen(opening)
+	moves := []string{}
+	hashes := []uint64{board.Hash()}
+
+	for ply := 0; ; ply++ {
+		legal_moves := board.GenerateLegalMoves()
+		if len(legal_moves) == 0 {
+			if board.OurKingInCheck() {
+				return positions, []string{"0.0", "1.0"}[GetColor(board.Wtomove)], true, nil // checkmate
+			}
+			return positions, "0.5", true, nil // stalemate
+		}
+		if board.Halfmoveclock >= 100 || IsInsufficientMaterial(&board) || ply >= MAX_GAME_PLIES {
+			return positions, "0.5", true, nil
+		}
+		repetitions := 0
+		for i := len(hashes) - 1; i >= max(0, len(hashes)-1-int(board.Halfmoveclock)); i-- {
+			if hashes[i] == board.Hash() {
+				repetitions++
+			}
+		}
+		if repetitions >= 3 {
+			return positions, "0.5", true, nil // threefold repetition
+		}
+
+		position := "position fen " + opening
+		if len(moves) > 0 {
+			position += " moves " + strings.Join(moves, " ")
+		}
+		move_str, score, is_mate, has_score, err := engine.Search(position, nodes)
+		if err != nil {
+			return nil, "", false, err
+		}
+		move, err := dragontoothmg.ParseMove(move_str)
+		if err != nil {
+			return nil, "", false, fmt.Errorf("invalid best move %q", move_str)
+		}
+		white_score := score
+		if !board.Wtomove {
+			white_score = -score
+		}
+
+		if ply == 0 && has_score && (is_mate || abs(score) > MAX_OPENING_SCORE) {
+			return nil, "", false, nil // unbalanced opening
+		}
+		if is_mate {
+			// The game is adjudicated once a mate is found
+			if white_score > 0 {
+				return positions, "1.0", true, nil
+			}
+			return positions, "0.0", true, nil
+		}
+
+		// Noisy positions are filtered: the score of the search doesn't match the static eval of the position
+		noisy := board.OurKingInCheck() || dragontoothmg.IsCapture(move, &board) || move.Promote() != dragontoothmg.Nothing
+		if has_score && !noisy {
+			positions = append(positions, fmt.Sprintf("%v | %v", board.ToFen(), white_score))
+		}
+
+		board.Apply(move)
+		moves = append(moves, move_str)
+		hashes = append(hashes, board.Hash())
+	}
+}
+
+// Generates training data to a file, with games played in parallel
+func RunDatagen(output_filename string, options DatagenOptions) error {
+	start_positions := []string{dragontoothmg.Startpos}
+	if options.Book != "" {
+		var err error
+		if start_positions, err = LoadEPDBook(options.Book); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.Create(output_filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	writer := bufio.NewWriter(file)
+
+	var mutex sync.Mutex // protects the writer and the counters
+	var wait_group sync.WaitGroup
+	var games_started atomic.Int64
+	var stopped atomic.Bool // set when a worker fails, so that the other workers stop before their next game
+	games_played, num_positions := 0, 0
+	var worker_error error
+	fail := func(err error) {
+		mutex.Lock()
+		if worker_error == nil {
+			worker_error = err
+		}
+		mutex.Unlock()
+		stopped.Store(true)
+	}
+	start := time.Now()
+
+	// The search keeps its state (stacks, history tables, accumulators...) in globals, so the games can't be searched
+	// by goroutines of this process. Instead, each goroutine starts its own engine process: this executable (found with
+	// os.Executable, so it must still be at the same path), driven with UCI commands. The scores are parsed from the
+	// `info ... score` lines of the search, so the datagen depends on this output format.
+	for thread := 0; thread < options.Threads; thread++ {
+		wait_group.Add(1)
+		go func(seed int64) {
+			defer wait_group.Done()
+			rng := rand.New(rand.NewSource(seed))
+			engine, err := StartDatagenEngine(options.Hash)
+			if err != nil {
+				fail(err)
+				return
+			}
+			defer engine.Close()
+
+			for !stopped.Load() && games_started.Add(1) <= int64(options.Games) {
+				var positions []string
+				var result string
+				ok := false
+				for attempt := 0; !ok && err == nil; attempt++ {
+					if attempt == MAX_OPENING_ATTEMPTS {
+						err = fmt.Errorf("no valid opening found in %v attempts (the games end during the random plies, "+
+							"or the openings are too unbalanced)", MAX_OPENING_ATTEMPTS)
+						break
+					}
+					opening, valid := RandomOpening(start_positions[rng.Intn(len(start_positions))], options.RandomPlies, rng)
+					if valid {
+						positions, result, ok, err = PlayDatagenGame(engine, opening, options.Nodes)
+					}
+				}
+
+				if err != nil {
+					fail(err)
+					return
+				}
+				mutex.Lock()
+				for _, position := range positions {
+					fmt.Fprintf(writer, "%v | %v\n", position, result)
+				}
+				games_played++
+				num_positions += len(positions)
+				if games_played%100 == 0 || games_played == options.Games {
+					elapsed := time.Since(start).Seconds()
+					fmt.Printf("%v games, %v positions (%.0f positions/s)\n", games_played, num_positions, float64(num_positions)/elapsed)
+				}
+				mutex.Unlock()
+			}
+		}(options.Seed + int64(thread))
+	}
+	wait_group.Wait()
+
+	// The finished games are kept even if a worker failed
+	flush_error := writer.Flush()
+	if worker_error != nil {
+		return worker_error
+	}
+	if flush_error != nil {
+		return flush_error
+	}
+	return file.Close()
+}
@@ -313,6 +313,13 @@ func popcount(x uint64) int {
 	return i
 }
 
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
 func KingVirtualMobility(board *dragontoothmg.Board, white bool, king_pos uint8) int {
 	var friendly_pieces uint64
 	if white {
@@ -1,5 +1,81 @@
 package main
 
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+)
+
 func main() {
+	flag.StringVar(&EvalFile, "evalfile", "", "network file to use instead of the embedded network")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: simplex [flags]               start the UCI interface")
+		fmt.Fprintln(os.Stderr, "       simplex convert [-hidden n] [-output-buckets n] [-king-buckets list] [-mirror]")
+		fmt.Fprintln(os.Stderr, "                       [-qa n] [-qb n] [-scale n] <raw> <output>")
+		fmt.Fprintln(os.Stderr, "                                     convert a raw bullet network to a network file")
+		fmt.Fprintln(os.Stderr, "       simplex datagen [-games n] [-nodes n] [-threads n] [-random-plies n] [-book file]")
+		fmt.Fprintln(os.Stderr, "                       [-hash n] [-seed n] <output>")
+		fmt.Fprintln(os.Stderr, "                                     generate training data with self-play games")
+		fmt.Fprintln(os.Stderr, "                                     (each thread runs a simplex engine process, over UCI)")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.Arg(0) == "convert" {
+		header := DefaultNNUEHeader()
+		convert_flags := flag.NewFlagSet("convert", flag.ExitOnError)
+		hidden_size := convert_flags.Uint("hidden", uint(header.HiddenSize), "hidden layer size")
+		output_buckets := convert_flags.Uint("output-buckets", uint(header.OutputBuckets), "number of material output buckets")
+		qa := convert_flags.Uint("qa", uint(header.QA), "quantisation of the accumulator")
+		qb := convert_flags.Uint("qb", uint(header.QB), "quantisation of the output layer")
+		scale := convert_flags.Uint("scale", uint(header.Scale), "evaluation scale")
+		king_buckets := convert_flags.String("king-buckets", "",
+			"comma-separated input bucket of each king square from a1 to h8 (32 squares from a1 to d8 if mirrored)")
+		mirror := convert_flags.Bool("mirror", false, "mirror the board horizontally when the king is on files e-h")
+		convert_flags.Parse(flag.Args()[1:])
+		if convert_flags.NArg() != 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		header.HiddenSize = uint32(*hidden_size)
+		header.OutputBuckets = uint32(*output_buckets)
+		header.QA, header.QB, header.Scale = uint32(*qa), uint32(*qb), uint32(*scale)
+		layout, num_buckets, err := ParseKingBuckets(*king_buckets, *mirror)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "invalid king buckets:", err)
+			os.Exit(2)
+		}
+		header.InputBuckets = uint32(num_buckets)
+		if err := ConvertRawNetwork(convert_flags.Arg(0), convert_flags.Arg(1), header, layout); err != nil {
+			fmt.Fprintln(os.Stderr, "could not convert network:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "datagen" {
+		var options DatagenOptions
+		datagen_flags := flag.NewFlagSet("datagen", flag.ExitOnError)
+		datagen_flags.IntVar(&options.Games, "games", 1000, "number of games to play")
+		datagen_flags.IntVar(&options.Nodes, "nodes", 5000, "number of nodes per search")
+		datagen_flags.IntVar(&options.Threads, "threads", runtime.NumCPU(), "number of games played in parallel (one engine process each)")
+		datagen_flags.IntVar(&options.RandomPlies, "random-plies", 8, "number of random plies at the start of each game")
+		datagen_flags.StringVar(&options.Book, "book", "", "EPD file of starting positions (instead of the standard starting position)")
+		datagen_flags.IntVar(&options.Hash, "hash", 16, "transposition table size of each engine (in MB)")
+		datagen_flags.Int64Var(&options.Seed, "seed", time.Now().UnixNano(), "random seed")
+		datagen_flags.Parse(flag.Args()[1:])
+		if datagen_flags.NArg() != 1 || options.Games < 1 || options.Nodes < 1 || options.Threads < 1 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		if err := RunDatagen(datagen_flags.Arg(0), options); err != nil {
+			fmt.Fprintln(os.Stderr, "could not generate data:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	LaunchUCI()
 }
@@ -1,25 +1,31 @@
 package main
 
 import (
-	"bytes"
 	_ "embed"
-	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"slices"
 
 	"github.com/dylhunn/dragontoothmg"
 )
 
-//go:embed nnue-weights.bin
+//go:embed simplex.nnue
 var NNUEData []byte
 
 const WHITE = 0
 const BLACK = 1
 
 const INPUT_SIZE = 768
-const HL_SIZE = 128
 
-const SCALE = 400
-const QA = 255
-const QB = 64
+// Architecture of the embedded network (the architecture of a loaded network is given by its header)
+const DEFAULT_HL_SIZE = 128
+const DEFAULT_SCALE = 400
+const DEFAULT_QA = 255
+const DEFAULT_QB = 64
+
+const MAX_HL_SIZE = 2048
+const MAX_INPUT_BUCKETS = 32
+const MAX_OUTPUT_BUCKETS = 16
 
 // Precomputed feature table, with indexing [square][piece - 1][color][perspective]
 var FeatIndexTable = [64][6][2][2]int16{}
@@ -43,14 +49,14 @@ func InitIndexTable() {
 	}
 }
 
-func SCReLu(x int16) int32 {
+func SCReLu(x int16, qa int16) int {
 	if x <= 0 {
 		x = 0
 	}
-	if x >= QA {
-		x = QA
+	if x >= qa {
+		x = qa
 	}
-	return int32(x) * int32(x)
+	return int(x) * int(x)
 }
 
 func BoardToVector(board *dragontoothmg.Board, perspective int) [768]int16 {
@@ -70,48 +76,163 @@ func BoardToVector(board *dragontoothmg.Board, perspective int) [768]int16 {
 }
 
 type Accumulator struct {
-	Values [HL_SIZE]int16
+	Values []int16 // [HiddenSize]
 }
 
-func (a *Accumulator) AddFeature(index int16, net *NeuralNet) {
-	for i := 0; i < HL_SIZE; i++ {
-		a.Values[i] += net.AccWeights[index][i]
-	}
+func NewAccumulator(hidden_size int) Accumulator {
+	return Accumulator{Values: make([]int16, hidden_size)}
 }
 
-func (a *Accumulator) SubFeature(index int16, net *NeuralNet) {
-	for i := 0; i < HL_SIZE; i++ {
-		a.Values[i] -= net.AccWeights[index][i]
-	}
+func (a *Accumulator) AddFeature(index int, net *NeuralNet) {
+	VecAdd(a.Values, net.FeatureWeights(index))
 }
 
+func (a *Accumulator) SubFeature(index int, net *NeuralNet) {
+	VecSub(a.Values, net.FeatureWeights(index))
+}
+
+// (INPUT_SIZE * InputBuckets -> HiddenSize)x2 -> OutputBuckets network, with SCReLU activation
+// The input bucket of each perspective is selected with the square of its king (with the board mirrored horizontally
+// when the king is on files e-h if Mirror is set), and the output bucket with the number of pieces on the board.
 type NeuralNet struct {
-	AccWeights [INPUT_SIZE][HL_SIZE]int16
-	AccBiases  [HL_SIZE]int16
-	OutWeights [2 * HL_SIZE]int16
-	OutBias    int16
-	WhiteAcc   Accumulator
-	BlackAcc   Accumulator
+	InputBuckets  int
+	Mirror        bool
+	KingBuckets   [64]int // Input bucket of each king square, from the perspective of the king's side
+	HiddenSize    int
+	OutputBuckets int
+	QA            int
+	QB            int
+	Scale         int
+	AccWeights    []int16        // [InputBuckets][INPUT_SIZE][HiddenSize]
+	AccBiases     []int16        // [HiddenSize]
+	OutWeights    []int16        // [OutputBuckets][2 * HiddenSize]
+	OutBiases     []int16        // [OutputBuckets]
+	RefreshCache  []RefreshEntry // [perspective][input bucket][mirrored]
+}
+
+// Input bucket and mirroring of the features of a perspective
+type FeatTransform struct {
+	Offset int // Offset of the features of the input bucket
+	Xor    int // 7 if the features are mirrored (which flips the file of the square), 0 otherwise
+}
+
+// Accumulator weights of a feature
+func (n *NeuralNet) FeatureWeights(index int) []int16 {
+	start := index * n.HiddenSize
+	return n.AccWeights[start : start+n.HiddenSize]
+}
+
+// Returns the feature transform of a perspective, given the square of its king
+func (n *NeuralNet) KingTransform(king_square uint8, perspective int) FeatTransform {
+	if perspective == BLACK {
+		king_square ^= 56
+	}
+	xor := 0
+	if n.Mirror && king_square%8 >= 4 {
+		king_square ^= 7
+		xor = 7
+	}
+	return FeatTransform{n.KingBuckets[king_square] * INPUT_SIZE, xor}
+}
+
+// Index of a feature (with the dragontoothmg piece type) for a perspective
+func (t FeatTransform) FeatureIndex(square uint8, piece int, color int, perspective int) int {
+	return t.Offset + (int(FeatIndexTable[square][piece-1][color][perspective]) ^ t.Xor)
+}
+
+func (n *NeuralNet) OutputBucket(board *dragontoothmg.Board) int {
+	divisor := (32 + n.OutputBuckets - 1) / n.OutputBuckets
+	num_pieces := popcount(board.White.All | board.Black.All)
+	return min((num_pieces-2)/divisor, n.OutputBuckets-1)
+}
+
+func KingSquare(board *dragontoothmg.Board, color int) uint8 {
+	if color == WHITE {
+		return uint8(bits.TrailingZeros64(board.White.Kings))
+	}
+	return uint8(bits.TrailingZeros64(board.Black.Kings))
 }
 
+// Resets the accumulator stack to a position
 func (n *NeuralNet) SetPosition(board *dragontoothmg.Board) {
+	AccumStackTop = 0
+	n.RefreshFromCache(board, WHITE)
+	n.RefreshFromCache(board, BLACK)
+}
+
+// Computes the accumulator of a perspective from scratch (without the stack or the refresh cache), selecting the
+// input bucket with the king square
+func (n *NeuralNet) ComputeAccumulator(board *dragontoothmg.Board, perspective int, acc *Accumulator) FeatTransform {
+	transform := n.KingTransform(KingSquare(board, perspective), perspective)
+
 	// Reset to biases
-	n.WhiteAcc.Values = n.AccBiases
-	n.BlackAcc.Values = n.AccBiases
+	copy(acc.Values, n.AccBiases)
 
 	for square := uint8(0); square < 64; square++ {
 		piece, is_white := dragontoothmg.GetPieceType(square, board)
 		if piece == dragontoothmg.Nothing {
 			continue
 		}
-		color := GetColor(is_white)
-		n.WhiteAcc.AddFeature(
-			FeatIndexTable[square][piece-1][color][WHITE], n,
-		)
-		n.BlackAcc.AddFeature(
-			FeatIndexTable[square][piece-1][color][BLACK], n,
-		)
+		acc.AddFeature(transform.FeatureIndex(square, piece, GetColor(is_white), perspective), n)
+	}
+	return transform
+}
+
+// Accumulator refresh cache ("Finny table")
+// For each perspective, input bucket and mirroring, the cache stores the accumulator of the last position refreshed
+// with them, along with its pieces. A refresh then only has to apply the pieces which differ from the cached position,
+// which are usually much fewer than all the pieces on the board.
+
+type RefreshEntry struct {
+	Acc    Accumulator
+	Pieces [2][6]uint64 // Bitboards of the cached position, indexed by [color][piece - 1]
+}
+
+func PieceBitboards(board *dragontoothmg.Board) [2][6]uint64 {
+	var pieces [2][6]uint64
+	for color, bitboards := range []*dragontoothmg.Bitboards{&board.White, &board.Black} {
+		pieces[color] = [6]uint64{
+			bitboards.Pawns, bitboards.Knights, bitboards.Bishops, bitboards.Rooks, bitboards.Queens, bitboards.Kings,
+		}
 	}
+	return pieces
+}
+
+// Resets all the cache entries to the empty board (whose accumulator only has the biases)
+func (n *NeuralNet) ResetRefreshCache() {
+	n.RefreshCache = make([]RefreshEntry, 2*n.InputBuckets*2)
+	for i := range n.RefreshCache {
+		n.RefreshCache[i].Acc = NewAccumulator(n.HiddenSize)
+		copy(n.RefreshCache[i].Acc.Values, n.AccBiases)
+	}
+}
+
+// Refreshes the accumulator of a perspective (at the top of the stack) by updating the cached accumulator of its input bucket
+func (n *NeuralNet) RefreshFromCache(board *dragontoothmg.Board, perspective int) {
+	transform := n.KingTransform(KingSquare(board, perspective), perspective)
+	entry := &n.RefreshCache[(perspective*n.InputBuckets+transform.Offset/INPUT_SIZE)*2+transform.Xor/7]
+
+	pieces := PieceBitboards(board)
+	for color := WHITE; color <= BLACK; color++ {
+		for piece := dragontoothmg.Pawn; piece <= dragontoothmg.King; piece++ {
+			cached := entry.Pieces[color][piece-1]
+			current := pieces[color][piece-1]
+			for removed := cached &^ current; removed != 0; removed &= removed - 1 {
+				square := uint8(bits.TrailingZeros64(removed))
+				entry.Acc.SubFeature(transform.FeatureIndex(square, piece, color, perspective), n)
+			}
+			for added := current &^ cached; added != 0; added &= added - 1 {
+				square := uint8(bits.TrailingZeros64(added))
+				entry.Acc.AddFeature(transform.FeatureIndex(square, piece, color, perspective), n)
+			}
+		}
+	}
+	entry.Pieces = pieces
+
+	stack_entry := &AccumStack[AccumStackTop]
+	copy(stack_entry.Accumulator(perspective).Values, entry.Acc.Values)
+	stack_entry.Transform[perspective] = transform
+	stack_entry.Computed[perspective] = true
 }
 
 // Converts a color to int
@@ -123,13 +244,38 @@ func GetColor(is_white bool) int {
 	}
 }
 
-func (n *NeuralNet) Update(board *dragontoothmg.Board, move dragontoothmg.Move) {
+type Feature struct {
+	Square uint8
+	Piece  int // dragontoothmg piece type
+	Color  int
+}
+
+// Features added and removed by a move (at most two of each, for captures and castling)
+type FeatureDelta struct {
+	Added      [2]Feature
+	Removed    [2]Feature
+	NumAdded   int
+	NumRemoved int
+}
+
+func (d *FeatureDelta) Add(square uint8, piece int, color int) {
+	d.Added[d.NumAdded] = Feature{square, piece, color}
+	d.NumAdded++
+}
+
+func (d *FeatureDelta) Remove(square uint8, piece int, color int) {
+	d.Removed[d.NumRemoved] = Feature{square, piece, color}
+	d.NumRemoved++
+}
+
+// Computes the features changed by a move (before it is applied to the board)
+func MoveDelta(board *dragontoothmg.Board, move dragontoothmg.Move) FeatureDelta {
+	var delta FeatureDelta
 	from_piece, is_white := dragontoothmg.GetPieceType(move.From(), board)
 	color := GetColor(is_white)
 
 	// Remove piece from source square
-	n.WhiteAcc.SubFeature(FeatIndexTable[move.From()][from_piece-1][color][WHITE], n)
-	n.BlackAcc.SubFeature(FeatIndexTable[move.From()][from_piece-1][color][BLACK], n)
+	delta.Remove(move.From(), from_piece, color)
 
 	// Determine what lands on the target square
 	to_piece := from_piece
@@ -138,16 +284,14 @@ func (n *NeuralNet) Update(board *dragontoothmg.Board, move dragontoothmg.Move)
 	}
 
 	// Add piece to target square
-	n.WhiteAcc.AddFeature(FeatIndexTable[move.To()][to_piece-1][color][WHITE], n)
-	n.BlackAcc.AddFeature(FeatIndexTable[move.To()][to_piece-1][color][BLACK], n)
+	delta.Add(move.To(), to_piece, color)
 
 	// Handle capture
 	if dragontoothmg.IsCapture(move, board) {
 		to_bitmask := uint64(1) << move.To()
 		if to_bitmask&board.White.All != 0 || to_bitmask&board.Black.All != 0 {
 			captured_piece, _ := dragontoothmg.GetPieceType(move.To(), board)
-			n.WhiteAcc.SubFeature(FeatIndexTable[move.To()][captured_piece-1][1-color][WHITE], n)
-			n.BlackAcc.SubFeature(FeatIndexTable[move.To()][captured_piece-1][1-color][BLACK], n)
+			delta.Remove(move.To(), captured_piece, 1-color)
 		} else {
 			// En passant
 			var ep_square uint8
@@ -156,8 +300,7 @@ func (n *NeuralNet) Update(board *dragontoothmg.Board, move dragontoothmg.Move)
 			} else {
 				ep_square = move.To() + 8
 			}
-			n.WhiteAcc.SubFeature(FeatIndexTable[ep_square][dragontoothmg.Pawn-1][1-color][WHITE], n)
-			n.BlackAcc.SubFeature(FeatIndexTable[ep_square][dragontoothmg.Pawn-1][1-color][BLACK], n)
+			delta.Remove(ep_square, dragontoothmg.Pawn, 1-color)
 		}
 	}
 
@@ -185,81 +328,169 @@ func (n *NeuralNet) Update(board *dragontoothmg.Board, move dragontoothmg.Move)
 			diff = -diff
 		}
 		if handled && diff == 2 {
-			n.WhiteAcc.SubFeature(FeatIndexTable[rookFrom][dragontoothmg.Rook-1][color][WHITE], n)
-			n.BlackAcc.SubFeature(FeatIndexTable[rookFrom][dragontoothmg.Rook-1][color][BLACK], n)
-			n.WhiteAcc.AddFeature(FeatIndexTable[rookTo][dragontoothmg.Rook-1][color][WHITE], n)
-			n.BlackAcc.AddFeature(FeatIndexTable[rookTo][dragontoothmg.Rook-1][color][BLACK], n)
+			delta.Remove(rookFrom, dragontoothmg.Rook, color)
+			delta.Add(rookTo, dragontoothmg.Rook, color)
 		}
 	}
+	return delta
 }
 
-func (n *NeuralNet) GetEval(w_to_move bool) int {
-	var stm_acc *Accumulator
-	var nstm_acc *Accumulator
-	if w_to_move {
-		stm_acc = &n.WhiteAcc
-		nstm_acc = &n.BlackAcc
-	} else {
-		stm_acc = &n.BlackAcc
-		nstm_acc = &n.WhiteAcc
-	}
+// Computes the accumulator of a perspective of a stack entry from the previous entry
+func (n *NeuralNet) ApplyDelta(index int, perspective int) {
+	entry := &AccumStack[index]
+	acc := entry.Accumulator(perspective)
+	transform := entry.Transform[perspective]
+	delta := &entry.Delta
+
+	// Every move moves a piece: the first added and removed features are applied in a single pass with the copy
+	added := transform.FeatureIndex(delta.Added[0].Square, delta.Added[0].Piece, delta.Added[0].Color, perspective)
+	removed := transform.FeatureIndex(delta.Removed[0].Square, delta.Removed[0].Piece, delta.Removed[0].Color, perspective)
+	VecAddSub(acc.Values, AccumStack[index-1].Accumulator(perspective).Values, n.FeatureWeights(added), n.FeatureWeights(removed))
 
-	eval := 0
+	for _, feature := range delta.Removed[1:delta.NumRemoved] {
+		acc.SubFeature(transform.FeatureIndex(feature.Square, feature.Piece, feature.Color, perspective), n)
+	}
+	for _, feature := range delta.Added[1:delta.NumAdded] {
+		acc.AddFeature(transform.FeatureIndex(feature.Square, feature.Piece, feature.Color, perspective), n)
+	}
+	entry.Computed[perspective] = true
+}
 
-	for i := 0; i < HL_SIZE; i++ {
-		eval += int(
-			SCReLu(stm_acc.Values[i])*int32(n.OutWeights[i]) + SCReLu(nstm_acc.Values[i])*int32(n.OutWeights[i+HL_SIZE]),
-		)
+// Makes sure that the accumulator of a perspective at the top of the stack is computed: the deltas are applied
+// from the last computed entry, unless the king changed of input bucket or crossed the mirroring boundary
+// in between, in which case all the features changed and the accumulator is refreshed from the current position.
+func (n *NeuralNet) Materialize(board *dragontoothmg.Board, perspective int) {
+	last := AccumStackTop
+	for last > 0 && !AccumStack[last].Computed[perspective] && !AccumStack[last].NeedsRefresh[perspective] {
+		last--
 	}
+	if !AccumStack[last].Computed[perspective] {
+		n.RefreshFromCache(board, perspective)
+		return
+	}
+	for index := last + 1; index <= AccumStackTop; index++ {
+		n.ApplyDelta(index, perspective)
+	}
+}
+
+func (n *NeuralNet) GetEval(board *dragontoothmg.Board) int {
+	n.Materialize(board, WHITE)
+	n.Materialize(board, BLACK)
+
+	entry := &AccumStack[AccumStackTop]
+	stm := GetColor(board.Wtomove)
+	stm_acc := entry.Accumulator(stm)
+	nstm_acc := entry.Accumulator(1 - stm)
 
-	eval /= QA
+	bucket := n.OutputBucket(board)
+	out_weights := n.OutWeights[2*n.HiddenSize*bucket : 2*n.HiddenSize*(bucket+1)]
+	stm_weights := out_weights[:n.HiddenSize]
+	nstm_weights := out_weights[n.HiddenSize:]
+	qa := int16(n.QA)
 
-	eval += int(n.OutBias)
+	eval := SCReLUDot(stm_acc.Values, stm_weights, qa) + SCReLUDot(nstm_acc.Values, nstm_weights, qa)
 
-	eval *= SCALE
-	eval /= QA * QB
+	eval /= n.QA
+
+	eval += int(n.OutBiases[bucket])
+
+	eval *= n.Scale
+	eval /= n.QA * n.QB
 
 	return eval / 2
 }
 
-func (n *NeuralNet) Load() {
-	// Read stored data
-	data := bytes.NewReader(NNUEData)
-
-	// Load weights
-	var acc_weights [INPUT_SIZE * HL_SIZE]int16
-	binary.Read(data, binary.LittleEndian, &acc_weights)
-	binary.Read(data, binary.LittleEndian, &n.AccBiases)
-	binary.Read(data, binary.LittleEndian, &n.OutWeights)
-	binary.Read(data, binary.LittleEndian, &n.OutBias)
-	for i := 0; i < INPUT_SIZE; i++ {
-		for j := 0; j < HL_SIZE; j++ {
-			n.AccWeights[i][j] = acc_weights[HL_SIZE*i+j]
-		}
-	}
+// Accumulator stack, with an entry per ply. The accumulators are updated lazily: making a move only records the
+// features it changes, and the accumulators are computed when the position is evaluated (which many positions never are).
+type AccumStackEntry struct {
+	White        Accumulator
+	Black        Accumulator
+	Delta        FeatureDelta     // Features changed by the move leading to this entry
+	Transform    [2]FeatTransform // Feature transform of each perspective
+	Computed     [2]bool          // Whether the accumulator of each perspective is up to date
+	NeedsRefresh [2]bool          // Whether the move changed the input bucket (or mirroring) of each perspective
 }
 
-type AccumulatorPair struct {
-	White Accumulator
-	Black Accumulator
+func (e *AccumStackEntry) Accumulator(perspective int) *Accumulator {
+	if perspective == WHITE {
+		return &e.White
+	}
+	return &e.Black
 }
 
-var AccumStack [MAX_PLY]AccumulatorPair
+var AccumStack [MAX_PLY]AccumStackEntry
 var AccumStackTop int = 0
 
 var Network = NeuralNet{}
 
-func PushAccum() {
-	AccumStack[AccumStackTop] = AccumulatorPair{Network.WhiteAcc, Network.BlackAcc}
+// Allocates the accumulators of the stack for the hidden size of the network
+func ResizeAccumStack(hidden_size int) {
+	for i := range AccumStack {
+		AccumStack[i] = AccumStackEntry{White: NewAccumulator(hidden_size), Black: NewAccumulator(hidden_size)}
+	}
+	AccumStackTop = 0
+}
+
+// Pushes a move (before it is applied to the board) on the accumulator stack, without computing the accumulators.
+// The stack can't overflow: it is reset at the root of each search, the game moves aren't pushed (see PlayGameMove),
+// and Negamax and Quiescence return the static eval at ply MAX_PLY - 1, without pushing moves
+// (null moves aren't pushed, so AccumStackTop <= ply)
+func PushAccum(board *dragontoothmg.Board, move dragontoothmg.Move) {
+	previous := &AccumStack[AccumStackTop]
 	AccumStackTop++
+	entry := &AccumStack[AccumStackTop]
+	entry.Delta = MoveDelta(board, move)
+	entry.Transform = previous.Transform
+	entry.Computed = [2]bool{false, false}
+	entry.NeedsRefresh = [2]bool{false, false}
+
+	moved := entry.Delta.Removed[0]
+	if moved.Piece == dragontoothmg.King {
+		transform := Network.KingTransform(move.To(), moved.Color)
+		if transform != previous.Transform[moved.Color] {
+			entry.Transform[moved.Color] = transform
+			entry.NeedsRefresh[moved.Color] = true
+		}
+	}
 }
 
 func PopAccum() {
 	AccumStackTop--
-	Network.WhiteAcc = AccumStack[AccumStackTop].White
-	Network.BlackAcc = AccumStack[AccumStackTop].Black
 }
 
 func ResetAccumStack() {
 	AccumStackTop = 0
 }
+
+// Debug mode, checking the incremental updates of the accumulators after every move
+var DebugNNUE bool = false
+var NNUEMismatches int = 0 // Number of positions where the accumulators were wrong since the start
+
+// Compares the accumulators at the top of the stack (after bringing them up to date) with accumulators computed
+// from scratch, and returns whether they are the same
+func (n *NeuralNet) CheckAccumulators(board *dragontoothmg.Board) bool {
+	expected := NewAccumulator(n.HiddenSize)
+	entry := &AccumStack[AccumStackTop]
+	for perspective := WHITE; perspective <= BLACK; perspective++ {
+		n.Materialize(board, perspective)
+		transform := n.ComputeAccumulator(board, perspective, &expected)
+		if transform != entry.Transform[perspective] || !slices.Equal(expected.Values, entry.Accumulator(perspective).Values) {
+			return false
+		}
+	}
+	return true
+}
+
+// Reports (and repairs) wrong accumulators, if the debug mode is enabled
+func DebugCheckAccumulators(board *dragontoothmg.Board) {
+	if !DebugNNUE || Network.CheckAccumulators(board) {
+		return
+	}
+	NNUEMismatches++
+	fmt.Println("info string NNUE accumulator mismatch at ply", AccumStackTop, "in position", board.ToFen())
+	entry := &AccumStack[AccumStackTop]
+	for perspective := WHITE; perspective <= BLACK; perspective++ {
+		entry.Transform[perspective] = Network.ComputeAccumulator(board, perspective, entry.Accumulator(perspective))
+		entry.Computed[perspective] = true
+	}
+}
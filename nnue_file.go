@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Network file format
+// A network file starts with a header describing the architecture, followed (since version 2) by the input layout
+// (king buckets and mirroring), and by the weights as little-endian int16: accumulator weights
+// [input buckets][input][hidden], accumulator biases [hidden], output weights [output buckets][2 * hidden]
+// and output biases [output buckets].
+// The checksum (CRC-32) covers everything after the header, so that a truncated or corrupted file is rejected.
+
+const NNUE_FILE_MAGIC = "SXNN"
+const NNUE_FILE_VERSION = 2
+
+const (
+	ACTIVATION_RELU = iota
+	ACTIVATION_CRELU
+	ACTIVATION_SCRELU
+)
+
+var ACTIVATION_NAMES = []string{"ReLU", "CReLU", "SCReLU"}
+
+type NNUEFileHeader struct {
+	Magic         [4]byte
+	Version       uint32
+	InputSize     uint32
+	HiddenSize    uint32
+	Activation    uint32
+	QA            uint32
+	QB            uint32
+	Scale         uint32
+	InputBuckets  uint32
+	OutputBuckets uint32
+	Checksum      uint32
+}
+
+// Version 1 files don't have an input layout: they have a single input bucket and no mirroring
+type NNUEInputLayout struct {
+	Mirror      uint32    // 1 if the board is mirrored horizontally when the king is on files e-h
+	KingBuckets [64]uint8 // Input bucket of each king square (only files a-d are used when mirrored)
+}
+
+// Header of the architecture of the embedded network
+func DefaultNNUEHeader() NNUEFileHeader {
+	header := NNUEFileHeader{
+		Version:       NNUE_FILE_VERSION,
+		InputSize:     INPUT_SIZE,
+		HiddenSize:    DEFAULT_HL_SIZE,
+		Activation:    ACTIVATION_SCRELU,
+		QA:            DEFAULT_QA,
+		QB:            DEFAULT_QB,
+		Scale:         DEFAULT_SCALE,
+		InputBuckets:  1,
+		OutputBuckets: 1,
+	}
+	copy(header.Magic[:], NNUE_FILE_MAGIC)
+	return header
+}
+
+func (h *NNUEFileHeader) String() string {
+	activation := "unknown activation"
+	if int(h.Activation) < len(ACTIVATION_NAMES) {
+		activation = ACTIVATION_NAMES[h.Activation]
+	}
+	return fmt.Sprintf("(%v -> %v)x2 -> 1, %v, QA %v, QB %v, scale %v, %v input buckets, %v output buckets",
+		h.InputSize, h.HiddenSize, activation, h.QA, h.QB, h.Scale, h.InputBuckets, h.OutputBuckets)
+}
+
+// Checks whether the engine supports the architecture described by the header and the input layout
+func (h *NNUEFileHeader) CheckArchitecture(layout *NNUEInputLayout) error {
+	if h.InputSize != INPUT_SIZE || h.Activation != ACTIVATION_SCRELU {
+		return fmt.Errorf("unsupported network architecture: %v", h.String())
+	}
+	if h.InputBuckets == 0 || h.InputBuckets > MAX_INPUT_BUCKETS {
+		return fmt.Errorf("unsupported number of input buckets %v (up to %v)", h.InputBuckets, MAX_INPUT_BUCKETS)
+	}
+	for square, bucket := range layout.KingBuckets {
+		if uint32(bucket) >= h.InputBuckets && (layout.Mirror == 0 || square%8 < 4) {
+			return fmt.Errorf("invalid king bucket %v for square %v (%v input buckets)", bucket, square, h.InputBuckets)
+		}
+	}
+	if layout.Mirror > 1 {
+		return fmt.Errorf("invalid mirroring flag %v", layout.Mirror)
+	}
+	if h.HiddenSize == 0 || h.HiddenSize > MAX_HL_SIZE || h.HiddenSize%16 != 0 {
+		return fmt.Errorf("unsupported hidden size %v (must be a multiple of 16, up to %v)", h.HiddenSize, MAX_HL_SIZE)
+	}
+	if h.OutputBuckets == 0 || h.OutputBuckets > MAX_OUTPUT_BUCKETS {
+		return fmt.Errorf("unsupported number of output buckets %v (up to %v)", h.OutputBuckets, MAX_OUTPUT_BUCKETS)
+	}
+	if h.QA == 0 || h.QA > 32767 || h.QB == 0 || h.Scale == 0 {
+		return fmt.Errorf("invalid quantisation: QA %v, QB %v, scale %v", h.QA, h.QB, h.Scale)
+	}
+	return nil
+}
+
+// Number of weights (and biases) of the network described by the header
+func (h *NNUEFileHeader) NumWeights() int {
+	input_size := int(h.InputSize) * int(h.InputBuckets)
+	hidden_size := int(h.HiddenSize)
+	return input_size*hidden_size + hidden_size + int(h.OutputBuckets)*(2*hidden_size+1)
+}
+
+// Loads the embedded network
+func (n *NeuralNet) Load() {
+	if err := n.LoadBytes(NNUEData); err != nil {
+		panic("invalid embedded network: " + err.Error())
+	}
+}
+
+// Loads a network from a file, keeping the current network if it fails
+func (n *NeuralNet) LoadFile(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	return n.LoadBytes(data)
+}
+
+func (n *NeuralNet) LoadBytes(network_data []byte) error {
+	data := bytes.NewReader(network_data)
+
+	var header NNUEFileHeader
+	if err := binary.Read(data, binary.LittleEndian, &header); err != nil {
+		return errors.New("invalid network file header")
+	}
+	if string(header.Magic[:]) != NNUE_FILE_MAGIC {
+		return errors.New("not a network file (raw networks must be converted first)")
+	}
+	if header.Version == 0 || header.Version > NNUE_FILE_VERSION {
+		return fmt.Errorf("unsupported network file version %v", header.Version)
+	}
+	if crc32.ChecksumIEEE(network_data[len(network_data)-data.Len():]) != header.Checksum {
+		return errors.New("invalid network checksum")
+	}
+
+	var layout NNUEInputLayout
+	if header.Version >= 2 {
+		if err := binary.Read(data, binary.LittleEndian, &layout); err != nil {
+			return errors.New("invalid network input layout")
+		}
+	}
+	if err := header.CheckArchitecture(&layout); err != nil {
+		return err
+	}
+
+	weights := make([]int16, header.NumWeights())
+	if data.Len() != 2*len(weights) {
+		return fmt.Errorf("invalid network size: %v bytes of weights instead of %v", data.Len(), 2*len(weights))
+	}
+	if err := binary.Read(data, binary.LittleEndian, weights); err != nil {
+		return err
+	}
+
+	// The network is only replaced once everything has been checked
+	hidden_size := int(header.HiddenSize)
+	output_buckets := int(header.OutputBuckets)
+	n.InputBuckets = int(header.InputBuckets)
+	n.Mirror = layout.Mirror == 1
+	for square, bucket := range layout.KingBuckets {
+		n.KingBuckets[square] = int(bucket)
+		if n.Mirror && square%8 >= 4 {
+			n.KingBuckets[square] = int(layout.KingBuckets[square^7])
+		}
+	}
+	n.HiddenSize = hidden_size
+	n.OutputBuckets = output_buckets
+	n.QA = int(header.QA)
+	n.QB = int(header.QB)
+	n.Scale = int(header.Scale)
+	input_size := INPUT_SIZE * n.InputBuckets
+	n.AccWeights, weights = weights[:input_size*hidden_size], weights[input_size*hidden_size:]
+	n.AccBiases, weights = weights[:hidden_size], weights[hidden_size:]
+	n.OutWeights, weights = weights[:2*hidden_size*output_buckets], weights[2*hidden_size*output_buckets:]
+	n.OutBiases = weights
+	n.ResetRefreshCache()
+	return nil
+}
+
+// Converts a raw network, as saved by bullet (weights only, padded to a multiple of 64 bytes),
+// to a network file with the given architecture
+func ConvertRawNetwork(input_filename string, output_filename string, header NNUEFileHeader, layout NNUEInputLayout) error {
+	if err := header.CheckArchitecture(&layout); err != nil {
+		return err
+	}
+	raw, err := os.ReadFile(input_filename)
+	if err != nil {
+		return err
+	}
+	size := 2 * header.NumWeights()
+	if len(raw) < size || len(raw) >= size+64 {
+		return fmt.Errorf("invalid raw network size: %v bytes instead of %v for %v", len(raw), size, header.String())
+	}
+	raw = raw[:size] // remove the padding
+
+	var layout_data bytes.Buffer
+	binary.Write(&layout_data, binary.LittleEndian, &layout)
+	header.Checksum = crc32.Update(crc32.ChecksumIEEE(layout_data.Bytes()), crc32.IEEETable, raw)
+
+	file, err := os.Create(output_filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	writer := bufio.NewWriter(file)
+	if err := binary.Write(writer, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	if _, err := writer.Write(layout_data.Bytes()); err != nil {
+		return err
+	}
+	if _, err := writer.Write(raw); err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// Parses a comma-separated king bucket map (64 squares, or 32 squares on files a-d if mirrored, from a1 to h8),
+// and returns the input layout and the number of input buckets
+func ParseKingBuckets(bucket_list string, mirror bool) (NNUEInputLayout, int, error) {
+	var layout NNUEInputLayout
+	if mirror {
+		layout.Mirror = 1
+	}
+	if bucket_list == "" {
+		return layout, 1, nil
+	}
+
+	fields := strings.Split(bucket_list, ",")
+	files := 8
+	if mirror && len(fields) == 32 {
+		files = 4
+	}
+	if len(fields) != 8*files {
+		return layout, 0, fmt.Errorf("%v buckets instead of 64 (or 32 if mirrored)", len(fields))
+	}
+	num_buckets := 0
+	for i, field := range fields {
+		bucket, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || bucket < 0 || bucket >= MAX_INPUT_BUCKETS {
+			return layout, 0, fmt.Errorf("invalid bucket %q", field)
+		}
+		square := (i/files)*8 + i%files
+		layout.KingBuckets[square] = uint8(bucket)
+		if files == 4 {
+			layout.KingBuckets[square^7] = uint8(bucket)
+		}
+		num_buckets = max(num_buckets, bucket+1)
+	}
+	return layout, num_buckets, nil
+}
@@ -0,0 +1,40 @@
+package main
+
+// Pure Go versions of the NNUE kernels, used when no assembly version is available
+// (and as the reference for the assembly versions, see TestSIMDKernels)
+
+// dst += w
+func VecAddGeneric(dst []int16, w []int16) {
+	dst = dst[:len(w)]
+	for i := range dst {
+		dst[i] += w[i]
+	}
+}
+
+// dst -= w
+func VecSubGeneric(dst []int16, w []int16) {
+	dst = dst[:len(w)]
+	for i := range dst {
+		dst[i] -= w[i]
+	}
+}
+
+// dst = src + add - sub
+func VecAddSubGeneric(dst []int16, src []int16, add []int16, sub []int16) {
+	dst = dst[:len(src)]
+	add = add[:len(src)]
+	sub = sub[:len(src)]
+	for i := range dst {
+		dst[i] = src[i] + add[i] - sub[i]
+	}
+}
+
+// Returns the sum of SCReLU(acc[i]) * w[i]
+func SCReLUDotGeneric(acc []int16, w []int16, qa int16) int {
+	acc = acc[:len(w)]
+	sum := 0
+	for i := range acc {
+		sum += SCReLu(acc[i], qa) * int(w[i])
+	}
+	return sum
+}
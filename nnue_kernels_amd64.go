@@ -0,0 +1,125 @@
+//go:build amd64 && !purego
+
+package main
+
+// Assembly versions of the NNUE kernels (see nnue_kernels_amd64.s), with AVX2 or SSE instructions.
+// The kernels process blocks of 16 values, the remaining values (when the length isn't a multiple of 16) are
+// processed by the Go versions.
+// The SCReLU kernels compute the products on 32 bits, so they are only used when QA <= 255.
+
+func cpuid(eax_arg uint32, ecx_arg uint32) (eax uint32, ebx uint32, ecx uint32, edx uint32)
+func xgetbv() (eax uint32, edx uint32)
+
+func vecAddAVX2(dst *int16, w *int16, n int)
+func vecSubAVX2(dst *int16, w *int16, n int)
+func vecAddSubAVX2(dst *int16, src *int16, add *int16, sub *int16, n int)
+func screluDotAVX2(acc *int16, w *int16, n int, qa int16) int
+
+func vecAddSSE2(dst *int16, w *int16, n int)
+func vecSubSSE2(dst *int16, w *int16, n int)
+func vecAddSubSSE2(dst *int16, src *int16, add *int16, sub *int16, n int)
+func screluDotSSE41(acc *int16, w *int16, n int, qa int16) int
+
+// SSE2 is always available on amd64
+var HasAVX2, HasSSE41 = DetectSIMD()
+
+func SIMDName() string {
+	if HasAVX2 {
+		return "AVX2"
+	} else if HasSSE41 {
+		return "SSE4.1"
+	}
+	return "SSE2"
+}
+
+// Instruction sets which can be used on this CPU, from the best one
+func SIMDLevels() []string {
+	available_avx2, available_sse41 := DetectSIMD()
+	levels := []string{}
+	if available_avx2 {
+		levels = append(levels, "AVX2")
+	}
+	if available_sse41 {
+		levels = append(levels, "SSE4.1")
+	}
+	return append(levels, "SSE2")
+}
+
+// Selects the instruction set used by the kernels (one of SIMDLevels)
+func SetSIMDLevel(level string) {
+	HasAVX2 = level == "AVX2"
+	HasSSE41 = level == "AVX2" || level == "SSE4.1"
+}
+
+func DetectSIMD() (bool, bool) {
+	max_leaf, _, _, _ := cpuid(0, 0)
+	_, _, ecx1, _ := cpuid(1, 0)
+	has_sse41 := ecx1&(1<<19) != 0
+	if max_leaf < 7 || ecx1&(1<<27) == 0 || ecx1&(1<<28) == 0 {
+		return false, has_sse41 // no AVX, or not enabled by the OS (OSXSAVE)
+	}
+	if xcr0, _ := xgetbv(); xcr0&6 != 6 {
+		return false, has_sse41 // the OS doesn't save the YMM registers
+	}
+	_, ebx7, _, _ := cpuid(7, 0)
+	return ebx7&(1<<5) != 0, has_sse41
+}
+
+// Length of the part of a vector processed by the assembly kernels
+func SIMDLength(n int) int {
+	return n &^ 15
+}
+
+func VecAdd(dst []int16, w []int16) {
+	n := SIMDLength(len(w))
+	if n > 0 {
+		_ = dst[n-1]
+		if HasAVX2 {
+			vecAddAVX2(&dst[0], &w[0], n)
+		} else {
+			vecAddSSE2(&dst[0], &w[0], n)
+		}
+	}
+	VecAddGeneric(dst[n:], w[n:])
+}
+
+func VecSub(dst []int16, w []int16) {
+	n := SIMDLength(len(w))
+	if n > 0 {
+		_ = dst[n-1]
+		if HasAVX2 {
+			vecSubAVX2(&dst[0], &w[0], n)
+		} else {
+			vecSubSSE2(&dst[0], &w[0], n)
+		}
+	}
+	VecSubGeneric(dst[n:], w[n:])
+}
+
+func VecAddSub(dst []int16, src []int16, add []int16, sub []int16) {
+	n := SIMDLength(len(src))
+	if n > 0 {
+		_, _, _ = dst[n-1], add[n-1], sub[n-1]
+		if HasAVX2 {
+			vecAddSubAVX2(&dst[0], &src[0], &add[0], &sub[0], n)
+		} else {
+			vecAddSubSSE2(&dst[0], &src[0], &add[0], &sub[0], n)
+		}
+	}
+	VecAddSubGeneric(dst[n:], src[n:], add[n:], sub[n:])
+}
+
+func SCReLUDot(acc []int16, w []int16, qa int16) int {
+	n := SIMDLength(len(w))
+	if n == 0 || qa > 255 || !HasSSE41 {
+		return SCReLUDotGeneric(acc, w, qa)
+	}
+	_ = acc[n-1]
+	sum := 0
+	if HasAVX2 {
+		sum = screluDotAVX2(&acc[0], &w[0], n, qa)
+	} else {
+		sum = screluDotSSE41(&acc[0], &w[0], n, qa)
+	}
+	return sum + SCReLUDotGeneric(acc[n:], w[n:], qa)
+}
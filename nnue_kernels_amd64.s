@@ -0,0 +1,271 @@
+//go:build amd64 && !purego
+
+#include "textflag.h"
+
+// func cpuid(eax_arg uint32, ecx_arg uint32) (eax uint32, ebx uint32, ecx uint32, edx uint32)
+TEXT ·cpuid(SB), NOSPLIT, $0-24
+	MOVL eax_arg+0(FP), AX
+	MOVL ecx_arg+4(FP), CX
+	CPUID
+	MOVL AX, eax+8(FP)
+	MOVL BX, ebx+12(FP)
+	MOVL CX, ecx+16(FP)
+	MOVL DX, edx+20(FP)
+	RET
+
+// func xgetbv() (eax uint32, edx uint32)
+TEXT ·xgetbv(SB), NOSPLIT, $0-8
+	MOVL $0, CX
+	XGETBV
+	MOVL AX, eax+0(FP)
+	MOVL DX, edx+4(FP)
+	RET
+
+// AVX2 kernels (16 values per iteration)
+
+// func vecAddAVX2(dst *int16, w *int16, n int)
+TEXT ·vecAddAVX2(SB), NOSPLIT, $0-24
+	MOVQ dst+0(FP), DI
+	MOVQ w+8(FP), SI
+	MOVQ n+16(FP), CX
+	SHRQ $4, CX
+	JZ   add_avx2_done
+
+add_avx2_loop:
+	VMOVDQU (DI), Y0
+	VPADDW  (SI), Y0, Y0
+	VMOVDQU Y0, (DI)
+	ADDQ    $32, DI
+	ADDQ    $32, SI
+	DECQ    CX
+	JNZ     add_avx2_loop
+
+add_avx2_done:
+	VZEROUPPER
+	RET
+
+// func vecSubAVX2(dst *int16, w *int16, n int)
+TEXT ·vecSubAVX2(SB), NOSPLIT, $0-24
+	MOVQ dst+0(FP), DI
+	MOVQ w+8(FP), SI
+	MOVQ n+16(FP), CX
+	SHRQ $4, CX
+	JZ   sub_avx2_done
+
+sub_avx2_loop:
+	VMOVDQU (DI), Y0
+	VPSUBW  (SI), Y0, Y0
+	VMOVDQU Y0, (DI)
+	ADDQ    $32, DI
+	ADDQ    $32, SI
+	DECQ    CX
+	JNZ     sub_avx2_loop
+
+sub_avx2_done:
+	VZEROUPPER
+	RET
+
+// func vecAddSubAVX2(dst *int16, src *int16, add *int16, sub *int16, n int)
+TEXT ·vecAddSubAVX2(SB), NOSPLIT, $0-40
+	MOVQ dst+0(FP), DI
+	MOVQ src+8(FP), SI
+	MOVQ add+16(FP), R8
+	MOVQ sub+24(FP), R9
+	MOVQ n+32(FP), CX
+	SHRQ $4, CX
+	JZ   addsub_avx2_done
+
+addsub_avx2_loop:
+	VMOVDQU (SI), Y0
+	VPADDW  (R8), Y0, Y0
+	VPSUBW  (R9), Y0, Y0
+	VMOVDQU Y0, (DI)
+	ADDQ    $32, DI
+	ADDQ    $32, SI
+	ADDQ    $32, R8
+	ADDQ    $32, R9
+	DECQ    CX
+	JNZ     addsub_avx2_loop
+
+addsub_avx2_done:
+	VZEROUPPER
+	RET
+
+// The products v * v * w (with v = clamp(acc, 0, qa)) are computed on 32 bits, where they always fit,
+// and summed on 64 bits (with one accumulator for each half of the 16 values), so that the result is exactly
+// the one of the Go version.
+
+// func screluDotAVX2(acc *int16, w *int16, n int, qa int16) int
+TEXT ·screluDotAVX2(SB), NOSPLIT, $0-40
+	MOVQ    acc+0(FP), SI
+	MOVQ    w+8(FP), DI
+	MOVQ    n+16(FP), CX
+	MOVWQSX qa+24(FP), AX
+	MOVQ    AX, X7
+	VPBROADCASTW X7, Y7
+	VPXOR   Y6, Y6, Y6
+	VPXOR   Y5, Y5, Y5
+	VPXOR   Y8, Y8, Y8
+	SHRQ    $4, CX
+	JZ      screlu_avx2_sum
+
+screlu_avx2_loop:
+	VMOVDQU   (SI), Y0
+	VPMAXSW   Y6, Y0, Y0
+	VPMINSW   Y7, Y0, Y0
+	VEXTRACTI128 $1, Y0, X1
+	VPMOVSXWD X0, Y0
+	VPMOVSXWD X1, Y1
+	VPMOVSXWD (DI), Y2
+	VPMOVSXWD 16(DI), Y3
+	VPMULLD   Y0, Y0, Y0
+	VPMULLD   Y2, Y0, Y0
+	VPMULLD   Y1, Y1, Y1
+	VPMULLD   Y3, Y1, Y1
+	VEXTRACTI128 $1, Y0, X2
+	VPMOVSXDQ X0, Y0
+	VPMOVSXDQ X2, Y2
+	VPADDQ    Y0, Y5, Y5
+	VPADDQ    Y2, Y5, Y5
+	VEXTRACTI128 $1, Y1, X3
+	VPMOVSXDQ X1, Y1
+	VPMOVSXDQ X3, Y3
+	VPADDQ    Y1, Y8, Y8
+	VPADDQ    Y3, Y8, Y8
+	ADDQ      $32, SI
+	ADDQ      $32, DI
+	DECQ      CX
+	JNZ       screlu_avx2_loop
+
+screlu_avx2_sum:
+	VPADDQ  Y8, Y5, Y5
+	VEXTRACTI128 $1, Y5, X3
+	VPADDQ  X3, X5, X5
+	VPSHUFD $0x4E, X5, X3
+	VPADDQ  X3, X5, X5
+	MOVQ    X5, AX
+	MOVQ    AX, ret+32(FP)
+	VZEROUPPER
+	RET
+
+// SSE kernels (8 values per iteration)
+
+// func vecAddSSE2(dst *int16, w *int16, n int)
+TEXT ·vecAddSSE2(SB), NOSPLIT, $0-24
+	MOVQ dst+0(FP), DI
+	MOVQ w+8(FP), SI
+	MOVQ n+16(FP), CX
+	SHRQ $3, CX
+	JZ   add_sse2_done
+
+add_sse2_loop:
+	MOVOU (DI), X0
+	MOVOU (SI), X1
+	PADDW X1, X0
+	MOVOU X0, (DI)
+	ADDQ  $16, DI
+	ADDQ  $16, SI
+	DECQ  CX
+	JNZ   add_sse2_loop
+
+add_sse2_done:
+	RET
+
+// func vecSubSSE2(dst *int16, w *int16, n int)
+TEXT ·vecSubSSE2(SB), NOSPLIT, $0-24
+	MOVQ dst+0(FP), DI
+	MOVQ w+8(FP), SI
+	MOVQ n+16(FP), CX
+	SHRQ $3, CX
+	JZ   sub_sse2_done
+
+sub_sse2_loop:
+	MOVOU (DI), X0
+	MOVOU (SI), X1
+	PSUBW X1, X0
+	MOVOU X0, (DI)
+	ADDQ  $16, DI
+	ADDQ  $16, SI
+	DECQ  CX
+	JNZ   sub_sse2_loop
+
+sub_sse2_done:
+	RET
+
+// func vecAddSubSSE2(dst *int16, src *int16, add *int16, sub *int16, n int)
+TEXT ·vecAddSubSSE2(SB), NOSPLIT, $0-40
+	MOVQ dst+0(FP), DI
+	MOVQ src+8(FP), SI
+	MOVQ add+16(FP), R8
+	MOVQ sub+24(FP), R9
+	MOVQ n+32(FP), CX
+	SHRQ $3, CX
+	JZ   addsub_sse2_done
+
+addsub_sse2_loop:
+	MOVOU (SI), X0
+	MOVOU (R8), X1
+	MOVOU (R9), X2
+	PADDW X1, X0
+	PSUBW X2, X0
+	MOVOU X0, (DI)
+	ADDQ  $16, DI
+	ADDQ  $16, SI
+	ADDQ  $16, R8
+	ADDQ  $16, R9
+	DECQ  CX
+	JNZ   addsub_sse2_loop
+
+addsub_sse2_done:
+	RET
+
+// func screluDotSSE41(acc *int16, w *int16, n int, qa int16) int
+TEXT ·screluDotSSE41(SB), NOSPLIT, $0-40
+	MOVQ    acc+0(FP), SI
+	MOVQ    w+8(FP), DI
+	MOVQ    n+16(FP), CX
+	MOVWQSX qa+24(FP), AX
+	MOVQ    AX, X7
+	PSHUFLW $0, X7, X7
+	PSHUFD  $0, X7, X7
+	PXOR    X6, X6
+	PXOR    X5, X5
+	SHRQ    $3, CX
+	JZ      screlu_sse41_sum
+
+screlu_sse41_loop:
+	MOVOU    (SI), X0
+	MOVOU    (DI), X1
+	PMAXSW   X6, X0
+	PMINSW   X7, X0
+	PMOVSXWD X0, X2
+	PMOVSXWD X1, X3
+	PSRLDQ   $8, X0
+	PSRLDQ   $8, X1
+	PMOVSXWD X0, X4
+	PMOVSXWD X1, X8
+	PMULLD   X2, X2
+	PMULLD   X3, X2
+	PMULLD   X4, X4
+	PMULLD   X8, X4
+	PMOVSXDQ X2, X9
+	PSRLDQ   $8, X2
+	PMOVSXDQ X2, X10
+	PMOVSXDQ X4, X11
+	PSRLDQ   $8, X4
+	PMOVSXDQ X4, X12
+	PADDQ    X9, X5
+	PADDQ    X10, X5
+	PADDQ    X11, X5
+	PADDQ    X12, X5
+	ADDQ     $16, SI
+	ADDQ     $16, DI
+	DECQ     CX
+	JNZ      screlu_sse41_loop
+
+screlu_sse41_sum:
+	PSHUFD $0x4E, X5, X9
+	PADDQ  X9, X5
+	MOVQ   X5, AX
+	MOVQ   AX, ret+32(FP)
+	RET
@@ -0,0 +1,29 @@
+//go:build !amd64 || purego
+
+package main
+
+func SIMDName() string {
+	return "none"
+}
+
+func SIMDLevels() []string {
+	return []string{"none"}
+}
+
+func SetSIMDLevel(level string) {}
+
+func VecAdd(dst []int16, w []int16) {
+	VecAddGeneric(dst, w)
+}
+
+func VecSub(dst []int16, w []int16) {
+	VecSubGeneric(dst, w)
+}
+
+func VecAddSub(dst []int16, src []int16, add []int16, sub []int16) {
+	VecAddSubGeneric(dst, src, add, sub)
+}
+
+func SCReLUDot(acc []int16, w []int16, qa int16) int {
+	return SCReLUDotGeneric(acc, w, qa)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+// Checks that the NNUE kernels give exactly the same results as the pure Go versions, with every instruction set
+// available on this CPU, on random vectors (with values over the whole int16 range, to check the overflows,
+// and with lengths which aren't always a multiple of 16)
+func TestSIMDKernels(t *testing.T) {
+	const num_tests = 2000
+	rng := rand.New(rand.NewSource(1))
+	random_vector := func(size int, limit int) []int16 {
+		vector := make([]int16, size)
+		for i := range vector {
+			vector[i] = int16(rng.Intn(2*limit+1) - limit)
+		}
+		return vector
+	}
+
+	detected_level := SIMDName()
+	defer SetSIMDLevel(detected_level)
+	for _, level := range SIMDLevels() {
+		SetSIMDLevel(level)
+		for i := 0; i < num_tests; i++ {
+			size := 16 * (1 + rng.Intn(MAX_HL_SIZE/16))
+			if i%2 == 1 {
+				size = 1 + rng.Intn(MAX_HL_SIZE)
+			}
+			limit := []int{100, 1000, 32767}[i%3]
+			src, add, sub := random_vector(size, limit), random_vector(size, limit), random_vector(size, limit)
+
+			expected, result := slices.Clone(src), slices.Clone(src)
+			VecAddGeneric(expected, add)
+			VecAdd(result, add)
+			if !slices.Equal(expected, result) {
+				t.Fatalf("%v: VecAdd differs from the Go version (length %v)", level, size)
+			}
+			VecSubGeneric(expected, sub)
+			VecSub(result, sub)
+			if !slices.Equal(expected, result) {
+				t.Fatalf("%v: VecSub differs from the Go version (length %v)", level, size)
+			}
+
+			VecAddSubGeneric(expected, src, add, sub)
+			VecAddSub(result, src, add, sub)
+			if !slices.Equal(expected, result) {
+				t.Fatalf("%v: VecAddSub differs from the Go version (length %v)", level, size)
+			}
+
+			qa := int16([]int{255, 127, 1 + rng.Intn(255)}[i%3])
+			if expected, result := SCReLUDotGeneric(src, add, qa), SCReLUDot(src, add, qa); expected != result {
+				t.Fatalf("%v: SCReLUDot gives %v instead of %v (length %v, QA %v)", level, result, expected, size, qa)
+			}
+		}
+	}
+}
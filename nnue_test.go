@@ -0,0 +1,154 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/dylhunn/dragontoothmg"
+)
+
+// Builds a network with random weights, with king buckets and mirroring, to check the bucket changes
+// (the embedded network has a single input bucket)
+func RandomNetwork(rng *rand.Rand) NeuralNet {
+	random_weights := func(size int) []int16 {
+		weights := make([]int16, size)
+		for i := range weights {
+			weights[i] = int16(rng.Intn(129) - 64)
+		}
+		return weights
+	}
+
+	net := NeuralNet{InputBuckets: 4, Mirror: true, HiddenSize: 32, OutputBuckets: 8,
+		QA: DEFAULT_QA, QB: DEFAULT_QB, Scale: DEFAULT_SCALE}
+	for square := range net.KingBuckets {
+		file, rank := square%8, square/8
+		net.KingBuckets[square] = min(rank, 3)
+		if file == 1 || file == 6 {
+			net.KingBuckets[square] = 3 - min(rank, 3)
+		}
+	}
+	net.AccWeights = random_weights(INPUT_SIZE * net.InputBuckets * net.HiddenSize)
+	net.AccBiases = random_weights(net.HiddenSize)
+	net.OutWeights = random_weights(2 * net.HiddenSize * net.OutputBuckets)
+	net.OutBiases = random_weights(net.OutputBuckets)
+	net.ResetRefreshCache()
+	return net
+}
+
+const (
+	MOVE_CAPTURE = iota
+	MOVE_CASTLING
+	MOVE_EN_PASSANT
+	MOVE_PROMOTION
+	MOVE_BUCKET_CHANGE // king move changing the input bucket or the mirroring of its perspective
+	NUM_MOVE_KINDS
+)
+
+var MOVE_KIND_NAMES = []string{"captures", "castling moves", "en passant captures", "promotions", "king bucket changes"}
+
+// Checks that the incrementally updated accumulators are the same as the accumulators computed from scratch after
+// every move and every take back, in perft trees and random games from positions with castling, en passant and
+// promotions, with the embedded network and a network with king buckets and mirroring
+func TestNNUEIncrementalConsistency(t *testing.T) {
+	const perft_depth = 3
+	const num_games = 20
+	positions := []string{
+		dragontoothmg.Startpos,
+		"r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq - 0 1",
+		"8/2p5/3p4/KP5r/1R3p1k/8/4P1P1/8 w - - 0 1",
+		"r3k2r/Pppp1ppp/1b3nbN/nP6/BBP1P3/q4N2/Pp1P2PP/R2Q1RK1 w kq - 0 1",
+		"rnbq1k1r/pp1Pbppp/2p5/8/2B5/8/PPP1NnPP/RNBQK2R w KQ - 1 8",
+		"8/1P4k1/8/3pP3/8/8/2K3p1/8 w - d6 0 1",
+	}
+
+	InitIndexTable()
+	old_use_nnue, old_network := UseNNUE, Network
+	Network.Load()
+	embedded_network := Network
+	defer func() {
+		UseNNUE, Network = old_use_nnue, old_network
+		ResizeAccumStack(Network.HiddenSize)
+		HashHistory = HashHistory[:0]
+	}()
+	UseNNUE = true
+	rng := rand.New(rand.NewSource(1))
+
+	for i, network := range []NeuralNet{embedded_network, RandomNetwork(rng)} {
+		Network = network
+		Network.ResetRefreshCache()
+		ResizeAccumStack(Network.HiddenSize)
+		move_kinds := [NUM_MOVE_KINDS]int{}
+
+		push := func(board *dragontoothmg.Board, move dragontoothmg.Move) func() {
+			piece, _ := dragontoothmg.GetPieceType(move.From(), board)
+			target, _ := dragontoothmg.GetPieceType(move.To(), board)
+			if dragontoothmg.IsCapture(move, board) {
+				move_kinds[MOVE_CAPTURE]++
+			}
+			if piece == dragontoothmg.King && (move.From()%8 == move.To()%8+2 || move.To()%8 == move.From()%8+2) {
+				move_kinds[MOVE_CASTLING]++
+			}
+			if piece == dragontoothmg.Pawn && move.From()%8 != move.To()%8 && target == dragontoothmg.Nothing {
+				move_kinds[MOVE_EN_PASSANT]++
+			}
+			if move.Promote() != dragontoothmg.Nothing {
+				move_kinds[MOVE_PROMOTION]++
+			}
+			fen := board.ToFen()
+			unapply_func := PushMove(board, move)
+			if AccumStack[AccumStackTop].NeedsRefresh != [2]bool{false, false} {
+				move_kinds[MOVE_BUCKET_CHANGE]++
+			}
+			if !Network.CheckAccumulators(board) {
+				t.Fatalf("network %v: wrong accumulators after %v in position %v", i, move.String(), fen)
+			}
+			return unapply_func
+		}
+		pop := func(board *dragontoothmg.Board, unapply_func func()) {
+			PopMove(board, unapply_func)
+			if !Network.CheckAccumulators(board) {
+				t.Fatalf("network %v: wrong accumulators after taking back a move in position %v", i, board.ToFen())
+			}
+		}
+
+		var perft func(board *dragontoothmg.Board, depth int)
+		perft = func(board *dragontoothmg.Board, depth int) {
+			if depth == 0 {
+				return
+			}
+			for _, move := range board.GenerateLegalMoves() {
+				unapply_func := push(board, move)
+				perft(board, depth-1)
+				pop(board, unapply_func)
+			}
+		}
+
+		for _, fen := range positions {
+			board := dragontoothmg.ParseFen(fen)
+			HashHistory = HashHistory[:0]
+			Network.SetPosition(&board)
+			perft(&board, perft_depth)
+
+			for game := 0; game < num_games; game++ {
+				unapply_funcs := []func(){}
+				for len(unapply_funcs) < MAX_PLY-1 {
+					legal_moves := board.GenerateLegalMoves()
+					if len(legal_moves) == 0 || board.Halfmoveclock >= 100 {
+						break
+					}
+					unapply_funcs = append(unapply_funcs, push(&board, legal_moves[rng.Intn(len(legal_moves))]))
+				}
+				for len(unapply_funcs) > 0 {
+					pop(&board, unapply_funcs[len(unapply_funcs)-1])
+					unapply_funcs = unapply_funcs[:len(unapply_funcs)-1]
+				}
+			}
+		}
+
+		for kind, count := range move_kinds {
+			if count == 0 && (kind != MOVE_BUCKET_CHANGE || Network.InputBuckets > 1) {
+				t.Fatalf("network %v: no %v were checked", i, MOVE_KIND_NAMES[kind])
+			}
+		}
+	}
+}
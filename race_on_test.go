@@ -0,0 +1,6 @@
+//go:build race
+
+package main
+
+// The race detector slows the search down too much for the tests with real clocks
+const RACE_ENABLED = true
@@ -15,13 +15,28 @@ const MAX_PLY int = 250
 
 const MATE_SCORE = 20000
 
-var RepetitionTable = map[int]int{}
+const NO_EVAL = -MATE_SCORE - 1 // Static eval stored for nodes in check
+
+// Hashes of all positions reached before the current one (game history + search stack), used for draw detection
+var HashHistory = make([]uint64, 0, 1024)
+
+// Indices in HashHistory of the positions reached after each null move of the search stack
+// (positions before a null move can't be repeated)
+var NullMoveFloors = make([]int, 0, MAX_PLY)
 
 var HistoryTable = [2][64][64]int{} // History table (for move ordering), indexed as [side2move][from][to]
 
 var KillerMoves = [MAX_PLY][2]dragontoothmg.Move{}
 
-const NULL_MOVE_REDUCTION int = 2 // Depth reduction for null move pruning
+var EvalStack = [MAX_PLY]int{} // Static eval of the nodes of the current search stack, indexed by ply
+
+// Triangular PV table: PVTable[ply][ply:PVLength[ply]] is the principal variation found from the node at this ply
+var PVTable = [MAX_PLY + 1][MAX_PLY + 1]dragontoothmg.Move{}
+var PVLength = [MAX_PLY + 1]int{}
+
+const NULL_MOVE_REDUCTION int = 3 // Base depth reduction for null move pruning
+
+const NMP_VERIFICATION_DEPTH int = 12 // Minimum depth for null move verification searches
 
 const MAX_HISTORY int = 1000 // Maximum history table value
 
@@ -45,6 +60,13 @@ var LMR_BASE float64 = 1.5
 
 var LMR_DIV float64 = 2.0
 
+var NMP_EVAL_DIV int = 200
+
+var PROBCUT_MARGIN int = 200
+
+// Null moves are disabled before this ply (during null move verification searches)
+var NMPMinPly int = 0
+
 // Time management flags
 
 var SearchStopped bool = false
@@ -81,31 +103,63 @@ func UpdateHistory(side_to_move int, from uint8, to uint8, bonus int) {
 	HistoryTable[side_to_move][from][to] += clamped_bonus - HistoryTable[side_to_move][from][to]*abs_clamped_bonus/MAX_HISTORY
 }
 
+// Plays a move of the game (and not of the search): the move is only added to the repetition history, so that
+// the search stacks (such as the accumulator stack) don't depend on the length of the game
+func PlayGameMove(board *dragontoothmg.Board, move dragontoothmg.Move) {
+	HashHistory = append(HashHistory, board.Hash())
+	board.Apply(move)
+}
+
 func PushMove(board *dragontoothmg.Board, move dragontoothmg.Move) func() {
 	if UseNNUE {
-		PushAccum()
-		Network.Update(board, move)
+		PushAccum(board, move)
 	}
+	HashHistory = append(HashHistory, board.Hash())
 	unapply_func := board.Apply(move)
-	_, exists := RepetitionTable[int(board.Hash())]
-	if !exists {
-		RepetitionTable[int(board.Hash())] = 1
-	} else {
-		RepetitionTable[int(board.Hash())]++
+	if UseNNUE {
+		DebugCheckAccumulators(board)
 	}
 	return unapply_func
 }
 
 func PopMove(board *dragontoothmg.Board, unapply_func func()) {
-	RepetitionTable[int(board.Hash())] -= 1
+	HashHistory = HashHistory[:len(HashHistory)-1]
 	unapply_func()
 	if UseNNUE {
 		PopAccum()
+		DebugCheckAccumulators(board)
+	}
+}
+
+func PushNullMove(board *dragontoothmg.Board) func() {
+	HashHistory = append(HashHistory, board.Hash())
+	NullMoveFloors = append(NullMoveFloors, len(HashHistory))
+	return board.ApplyNullMove()
+}
+
+func PopNullMove(board *dragontoothmg.Board, unapply_func func()) {
+	NullMoveFloors = NullMoveFloors[:len(NullMoveFloors)-1]
+	HashHistory = HashHistory[:len(HashHistory)-1]
+	unapply_func()
+}
+
+// Checks whether the move leading to the current position was a null move
+func LastMoveWasNull() bool {
+	return len(NullMoveFloors) != 0 && NullMoveFloors[len(NullMoveFloors)-1] == len(HashHistory)
+}
+
+// First index of HashHistory which can be used for repetition detection
+func HistoryFloor() int {
+	if len(NullMoveFloors) == 0 {
+		return 0
 	}
+	return NullMoveFloors[len(NullMoveFloors)-1]
 }
 
 var NodesSearched = 0 // initialise a node counter
 
+var PrintSearchInfo = true // Whether to print the info lines during the search
+
 func MoveScore(board *dragontoothmg.Board, move dragontoothmg.Move, ply int, tt_entry *TTEntry, in_tt bool) int {
 	if in_tt && move == tt_entry.BestMove {
 		return 10000
@@ -157,7 +211,7 @@ func OrderMoves(board *dragontoothmg.Board, moves []dragontoothmg.Move, ply int)
 	slices.SortFunc(
 		moves,
 		func(a, b dragontoothmg.Move) int {
-			return MoveScore(board, b, ply, tt_entry, in_tt) - MoveScore(board, a, ply, tt_entry, in_tt)
+			return MoveScore(board, b, ply, &tt_entry, in_tt) - MoveScore(board, a, ply, &tt_entry, in_tt)
 		})
 	return moves
 }
@@ -180,59 +234,135 @@ func MoveScoreQS(board *dragontoothmg.Board, move dragontoothmg.Move) int {
 	return score
 }
 
+// Sets the PV of a node to the move followed by the PV of the child node
+func UpdatePV(ply int, move dragontoothmg.Move) {
+	PVTable[ply][ply] = move
+	child_length := max(PVLength[ply+1], ply+1)
+	copy(PVTable[ply][ply+1:child_length], PVTable[ply+1][ply+1:child_length])
+	PVLength[ply] = child_length
+}
+
+// Checks whether the current position is a draw by repetition.
+// A single repetition of a position reached inside the search tree is enough, while positions
+// from the game history (before the root) have to be repeated twice.
+// Only positions since the last irreversible move (given by the halfmove clock) are checked.
+func IsRepetition(board *dragontoothmg.Board, ply int) bool {
+	hash := board.Hash()
+	last := len(HashHistory)
+	limit := max(HistoryFloor(), last-int(board.Halfmoveclock))
+	count := 0
+	for i := last - 4; i >= limit; i -= 2 { // same side to move, at least 4 plies are needed to repeat
+		if HashHistory[i] == hash {
+			if last-i < ply {
+				return true // repetition inside the search tree
+			}
+			count++
+			if count >= 2 {
+				return true // threefold repetition
+			}
+		}
+	}
+	return false
+}
+
+// Checks for draws by insufficient material (KvK, KBvK and KNvK)
+func IsInsufficientMaterial(board *dragontoothmg.Board) bool {
+	if board.White.Pawns|board.Black.Pawns|board.White.Rooks|board.Black.Rooks|board.White.Queens|board.Black.Queens != 0 {
+		return false
+	}
+	minor_pieces := board.White.Knights | board.White.Bishops | board.Black.Knights | board.Black.Bishops
+	return popcount(minor_pieces) <= 1
+}
+
+// Checks whether the side to move has pieces other than pawns (zugzwang is unlikely in that case)
+func HasNonPawnMaterial(board *dragontoothmg.Board) bool {
+	pieces := &board.White
+	if !board.Wtomove {
+		pieces = &board.Black
+	}
+	return pieces.Knights|pieces.Bishops|pieces.Rooks|pieces.Queens != 0
+}
+
 // Checks whether the score corresponds to a "mate in N" value
 func IsMateScore(score int) bool {
-	return (score > MATE_SCORE-300) || (score < -MATE_SCORE+300)
+	return (score >= MATE_SCORE-MAX_PLY) || (score <= -MATE_SCORE+MAX_PLY)
 }
 
-// Increases by one N in "mate in N"
-func CorrectMateScore(score int) int {
-	if score >= 0 {
-		return score - 1
+// Converts a mate score to the number of moves (not plies) until mate, negative if we are getting mated
+func MateIn(score int) int {
+	if score > 0 {
+		return (MATE_SCORE - score + 1) / 2
+	}
+	return -(MATE_SCORE + score) / 2
+}
+
+// Mate scores are stored in the TT relative to the node where they are found (and not the root),
+// so that a mate found at one ply is still correct when probed from another
+func ScoreToTT(score int, ply int) int {
+	if score >= MATE_SCORE-MAX_PLY {
+		return score + ply
+	} else if score <= -MATE_SCORE+MAX_PLY {
+		return score - ply
+	}
+	return score
+}
+
+// Converts back a score stored in the TT to a score relative to the root
+func ScoreFromTT(score int, ply int) int {
+	if score >= MATE_SCORE-MAX_PLY {
+		return score - ply
+	} else if score <= -MATE_SCORE+MAX_PLY {
+		return score + ply
+	}
+	return score
+}
+
+// Static eval from the point of view of the side to move, out of the range of mate scores
+func StaticEval(board *dragontoothmg.Board, color int) int {
+	var eval int
+	if UseNNUE {
+		eval = Network.GetEval(board)
 	} else {
-		return score + 1
+		eval = color * Evaluate(board)
 	}
+	return max(-MATE_SCORE+MAX_PLY+1, min(MATE_SCORE-MAX_PLY-1, eval))
 }
 
 // Note: depth parameter is currently unused, but can be used to limit the depth
-func Quiescence(board *dragontoothmg.Board, depth int, color int, alpha int, beta int) int {
-	NodesSearched++ // increment the node counter
+func Quiescence(board *dragontoothmg.Board, depth int, color int, alpha int, beta int, ply int) int {
+	PVLength[ply] = ply // no PV is collected in the quiescence search
+	NodesSearched++     // increment the node counter
 
-	if NodesSearched&4095 == 0 {
+	if NodesSearched&TimeCheckMask == 0 {
 		if time.Since(SearchStart).Seconds() >= HardTimeLimit {
 			SearchStopped = true
 			return 0
 		}
 	}
+	if NodeLimit > 0 && NodesSearched >= NodeLimit {
+		SearchStopped = true
+		return 0
+	}
 
 	if SearchStopped {
 		return 0
 	}
 
+	if ply >= MAX_PLY-1 {
+		return StaticEval(board, color) // the search stacks are full
+	}
+
 	legal_moves := board.GenerateLegalMoves()
 
 	if len(legal_moves) == 0 {
 		if board.OurKingInCheck() {
-			if board.Wtomove {
-				return -color * MATE_SCORE
-			} else {
-				return color * MATE_SCORE
-			}
+			return -MATE_SCORE + ply // checkmate
 		} else {
 			return 0
 		}
 	}
 
-	if RepetitionTable[int(board.Hash())] >= 3 {
-		return 0
-	}
-
-	var stand_pat int
-	if UseNNUE {
-		stand_pat = Network.GetEval(board.Wtomove)
-	} else {
-		stand_pat = color * Evaluate(board)
-	}
+	stand_pat := StaticEval(board, color)
 
 	if stand_pat >= beta {
 		return beta
@@ -279,7 +409,7 @@ func Quiescence(board *dragontoothmg.Board, depth int, color int, alpha int, bet
 		}
 
 		unapply_func := PushMove(board, move)
-		score := -Quiescence(board, depth-1, -color, -beta, -alpha)
+		score := -Quiescence(board, depth-1, -color, -beta, -alpha, ply+1)
 		PopMove(board, unapply_func)
 
 		if score >= beta {
@@ -289,98 +419,186 @@ func Quiescence(board *dragontoothmg.Board, depth int, color int, alpha int, bet
 		max_val = max(score, max_val)
 	}
 
-	if IsMateScore(max_val) {
-		max_val = CorrectMateScore(max_val)
-	}
-
 	return max_val
 }
 
 func Negamax(board *dragontoothmg.Board, depth int, color int, alpha int, beta int, ply int, in_pv bool, num_ext int) int {
+	PVLength[ply] = ply
 	NodesSearched++ // increment the node counter
 
-	if NodesSearched&4095 == 0 {
+	if NodesSearched&TimeCheckMask == 0 {
 		if time.Since(SearchStart).Seconds() >= HardTimeLimit {
 			SearchStopped = true
 			return 0
 		}
 	}
+	if NodeLimit > 0 && NodesSearched >= NodeLimit {
+		SearchStopped = true
+		return 0
+	}
 
 	if SearchStopped {
 		return 0
 	}
 
+	if ply >= MAX_PLY-1 {
+		return StaticEval(board, color) // the search stacks are full
+	}
+
 	in_check := board.OurKingInCheck()
 
 	legal_moves := board.GenerateLegalMoves()
 
 	if len(legal_moves) == 0 {
 		if in_check {
-			// Checkmate
-			if board.Wtomove {
-				return -color * MATE_SCORE
-			} else {
-				return color * MATE_SCORE
-			}
+			return -MATE_SCORE + ply // checkmate
 		} else {
 			return 0 // stalemate
 		}
 	}
 
-	if RepetitionTable[int(board.Hash())] >= 3 {
-		return 0 // threefold repetition
+	if IsRepetition(board, ply) {
+		return 0 // draw by repetition
 	}
 
 	if board.Halfmoveclock >= 100 {
 		return 0 // draw by fifty moves rule
 	}
 
+	if IsInsufficientMaterial(board) {
+		return 0 // draw by insufficient material
+	}
+
+	// Upcoming repetition detection
+	// If we can go back to a previous position, we can at least get a draw score
+	if alpha < 0 && HasUpcomingRepetition(board, ply) {
+		alpha = 0
+		if alpha >= beta {
+			return alpha
+		}
+	}
+
+	// Mate Distance Pruning
+	// Even if we mate at the next move, we can't do better than a mate already found closer to the root
+	alpha = max(alpha, -MATE_SCORE+ply)
+	beta = min(beta, MATE_SCORE-ply-1)
+	if alpha >= beta {
+		return alpha
+	}
+
 	board_hash := board.Hash()
 
 	tt_entry, in_tt := GetTT(board_hash)
 	// TT cutoff
-	if in_tt && tt_entry.Depth >= depth && RepetitionTable[int(board_hash)] < 2 {
+	if in_tt && tt_entry.Depth >= depth {
+		tt_score := ScoreFromTT(tt_entry.Score, ply)
 		if tt_entry.Bound == Exact ||
-			(tt_entry.Bound == Lower && tt_entry.Score >= beta) ||
-			(tt_entry.Bound == Upper && tt_entry.Score <= alpha) {
-			return tt_entry.Score
+			(tt_entry.Bound == Lower && tt_score >= beta) ||
+			(tt_entry.Bound == Upper && tt_score <= alpha) {
+			return tt_score
 		}
 	}
 
-	if depth == 0 {
-		return Quiescence(board, 3, color, alpha, beta)
+	if depth <= 0 {
+		return Quiescence(board, 3, color, alpha, beta, ply)
 	}
 
-	var eval int
-	if !in_check && !in_pv {
-		if UseNNUE {
-			eval = Network.GetEval(board.Wtomove)
+	raw_eval := NO_EVAL
+	eval := NO_EVAL
+	improving := false
+	if !in_check {
+		if in_tt && tt_entry.Eval != NO_EVAL {
+			raw_eval = tt_entry.Eval // static eval cached in the TT
+		} else {
+			raw_eval = StaticEval(board, color)
+		}
+		eval = CorrectEval(board, raw_eval)
+
+		// The position is improving if the static eval is better than two plies earlier
+		// (or four plies earlier if we were in check)
+		if ply >= 2 && EvalStack[ply-2] != NO_EVAL {
+			improving = eval > EvalStack[ply-2]
+		} else if ply >= 4 && EvalStack[ply-4] != NO_EVAL {
+			improving = eval > EvalStack[ply-4]
 		} else {
-			eval = color * Evaluate(board)
+			improving = true
 		}
+	}
+	EvalStack[ply] = eval
 
+	improving_int := 0
+	if improving {
+		improving_int = 1
+	}
+
+	if !in_check && !in_pv {
 		// Reverse Futility Pruning
-		if eval >= beta+(RFP_MARGIN*depth) {
+		if eval >= beta+(RFP_MARGIN*(depth-improving_int)) {
 			return eval
 		}
 
 		// Razoring
 		if depth <= 3 && eval+RAZOR_MARGIN*depth < alpha {
-			q_score := Quiescence(board, 3, color, alpha, beta)
+			q_score := Quiescence(board, 3, color, alpha, beta, ply)
 			if q_score < alpha {
 				return q_score
 			}
 		}
 
 		// Null move pruning (NMP)
-		num_pieces := popcount(board.White.All|board.Black.All) - 2 // Without kings
-		num_pawns := popcount(board.White.Pawns | board.Black.Pawns)
-		if num_pieces > num_pawns && num_pieces > 6 && depth >= 4 && eval >= beta {
-			unapply := board.ApplyNullMove()
-			score := -Negamax(board, depth-NULL_MOVE_REDUCTION-depth/6-1, -color, -beta, -(beta - 1), ply+1, false, num_ext)
-			unapply()
+		// Not done with only pawns left (because of zugzwang), after another null move or during a verification search
+		if depth >= 3 && eval >= beta && ply >= NMPMinPly && !LastMoveWasNull() &&
+			HasNonPawnMaterial(board) && !IsMateScore(beta) {
+			reduction := NULL_MOVE_REDUCTION + depth/3 + min((eval-beta)/NMP_EVAL_DIV, 3)
+			unapply := PushNullMove(board)
+			score := -Negamax(board, depth-reduction, -color, -beta, -(beta - 1), ply+1, false, num_ext)
+			PopNullMove(board, unapply)
 			if score >= beta {
-				return score
+				if IsMateScore(score) {
+					score = beta // mate scores from a null move search aren't proven
+				}
+
+				if depth < NMP_VERIFICATION_DEPTH || NMPMinPly != 0 {
+					return score
+				}
+
+				// Verification search: at high depth, search again without the null move (and with null moves
+				// disabled for the next plies) to avoid blunders in zugzwang positions
+				NMPMinPly = ply + 3*(depth-reduction)/4
+				verification_score := Negamax(board, depth-reduction, color, beta-1, beta, ply, false, num_ext)
+				NMPMinPly = 0
+
+				if verification_score >= beta {
+					return score
+				}
+			}
+		}
+
+		// ProbCut
+		// If a good capture beats beta by a margin with a reduced search, the node will very likely fail high
+		probcut_beta := beta + PROBCUT_MARGIN
+		if depth >= 5 && !IsMateScore(beta) &&
+			!(in_tt && tt_entry.Depth >= depth-3 && ScoreFromTT(tt_entry.Score, ply) < probcut_beta) {
+			for _, move := range legal_moves {
+				if !dragontoothmg.IsCapture(move, board) && move.Promote() == dragontoothmg.Nothing {
+					continue
+				}
+				if !SEE(board, move, probcut_beta-eval) {
+					continue
+				}
+
+				// Quiescence search first, to verify the capture before the more expensive reduced search
+				unapply_func := PushMove(board, move)
+				score := -Quiescence(board, 3, -color, -probcut_beta, -probcut_beta+1, ply+1)
+				if score >= probcut_beta {
+					score = -Negamax(board, depth-4, -color, -probcut_beta, -probcut_beta+1, ply+1, false, num_ext)
+				}
+				PopMove(board, unapply_func)
+
+				if score >= probcut_beta {
+					StoreTT(board_hash, move, ScoreToTT(score, ply), raw_eval, depth-3, Lower)
+					return score
+				}
 			}
 		}
 	}
@@ -413,7 +631,7 @@ func Negamax(board *dragontoothmg.Board, depth int, color int, alpha int, beta i
 	for i, move := range legal_moves {
 		scored[i] = ScoredMove{
 			Move:  move,
-			Score: MoveScore(board, move, ply, tt_entry, in_tt),
+			Score: MoveScore(board, move, ply, &tt_entry, in_tt),
 		}
 	}
 
@@ -447,7 +665,7 @@ func Negamax(board *dragontoothmg.Board, depth int, color int, alpha int, beta i
 		// Futility Pruning
 		if depth <= 3 && !in_check && !in_pv && !capture &&
 			!promotion && !IsMateScore(alpha) && !IsMateScore(beta) {
-			if eval+50+150*depth < alpha {
+			if eval+50+150*depth+50*improving_int < alpha {
 				continue
 			}
 			// if eval+120+80*lmr_depth < alpha {
@@ -456,8 +674,9 @@ func Negamax(board *dragontoothmg.Board, depth int, color int, alpha int, beta i
 		}
 
 		// Late Move Pruning
-		// Skip very late quiet moves, as they are probably not good
-		if depth <= 4 && !in_check && !in_pv && !capture && !promotion && move_index > 8+2*depth*depth {
+		// Skip very late quiet moves, as they are probably not good (earlier if the position is not improving)
+		if depth <= 4 && !in_check && !in_pv && !capture && !promotion &&
+			move_index > (8+2*depth*depth)*(1+improving_int)/2 {
 			continue
 		}
 
@@ -509,6 +728,10 @@ func Negamax(board *dragontoothmg.Board, depth int, color int, alpha int, beta i
 				reduction++
 			}
 
+			if !improving {
+				reduction++
+			}
+
 			reduction = max(1, min(reduction, depth-1))
 
 			if depth <= 2 {
@@ -536,6 +759,9 @@ func Negamax(board *dragontoothmg.Board, depth int, color int, alpha int, beta i
 			max_val = value
 			best_move = move
 		}
+		if value > alpha {
+			UpdatePV(ply, move)
+		}
 		alpha = max(alpha, value)
 
 		if alpha >= beta {
@@ -575,8 +801,8 @@ func Negamax(board *dragontoothmg.Board, depth int, color int, alpha int, beta i
 		}
 	}
 
-	if IsMateScore(max_val) {
-		max_val = CorrectMateScore(max_val)
+	if best_move == 0 {
+		return alpha // every move was pruned, which doesn't mean we are getting mated
 	}
 
 	var bound Bound
@@ -589,8 +815,15 @@ func Negamax(board *dragontoothmg.Board, depth int, color int, alpha int, beta i
 		bound = Exact
 	}
 
-	if (!in_tt || (in_tt && tt_entry.Depth <= depth) || (bound == Exact && tt_entry.Bound != Exact)) && best_move != 0 {
-		StoreTT(board_hash, best_move, max_val, depth, bound)
+	StoreTT(board_hash, best_move, ScoreToTT(max_val, ply), raw_eval, depth, bound)
+
+	// Correction history update
+	// Only done when the score is reliable compared to the static eval (not with a tactical best move,
+	// or with a bound which doesn't tell anything about the eval)
+	best_is_tactical := dragontoothmg.IsCapture(best_move, board) || best_move.Promote() != dragontoothmg.Nothing
+	if !in_check && !best_is_tactical && !SearchStopped && !IsMateScore(max_val) &&
+		!(bound == Lower && max_val <= eval) && !(bound == Upper && max_val >= eval) {
+		UpdateCorrectionHistory(board, depth, max_val, raw_eval)
 	}
 
 	return max_val
@@ -606,6 +839,15 @@ func NegamaxRoot(board dragontoothmg.Board, depth int, alpha int, beta int) (dra
 
 	original_alpha := alpha
 
+	PVLength[0] = 0
+
+	raw_eval := NO_EVAL
+	EvalStack[0] = NO_EVAL
+	if !board.OurKingInCheck() {
+		raw_eval = StaticEval(&board, color)
+		EvalStack[0] = CorrectEval(&board, raw_eval)
+	}
+
 	max_val := -MATE_SCORE
 	var best_move dragontoothmg.Move
 
@@ -621,6 +863,7 @@ func NegamaxRoot(board dragontoothmg.Board, depth int, alpha int, beta int) (dra
 		capture := dragontoothmg.IsCapture(move, &board)
 		promotion := move.Promote() != dragontoothmg.Nothing
 
+		nodes_before := NodesSearched
 		unapply_func := PushMove(&board, move)
 		if move_index <= 8 || capture || promotion {
 			value = -Negamax(&board, depth-1, -color, -beta, -alpha, 1, move_index == 0, 0)
@@ -633,11 +876,13 @@ func NegamaxRoot(board dragontoothmg.Board, depth int, alpha int, beta int) (dra
 			}
 		}
 		PopMove(&board, unapply_func)
+		RootMoveNodes[move] += NodesSearched - nodes_before
 		alpha = max(alpha, value)
 
 		if value > max_val || (best_move == 0 && value == max_val) {
 			max_val = value
 			best_move = move
+			UpdatePV(0, move)
 		}
 
 		if alpha >= beta {
@@ -645,10 +890,6 @@ func NegamaxRoot(board dragontoothmg.Board, depth int, alpha int, beta int) (dra
 		}
 	}
 
-	if IsMateScore(max_val) {
-		max_val = CorrectMateScore(max_val)
-	}
-
 	if best_move != 0 {
 		var bound Bound
 
@@ -660,21 +901,33 @@ func NegamaxRoot(board dragontoothmg.Board, depth int, alpha int, beta int) (dra
 			bound = Exact
 		}
 
-		StoreTT(board.Hash(), best_move, max_val, depth, bound)
+		StoreTT(board.Hash(), best_move, max_val, raw_eval, depth, bound)
 	}
 
 	return best_move, max_val
 }
 
+// Returns the principal variation from the root PV table, completed with the TT best moves when it was
+// cut short (by a TT cutoff for example). Every move is checked to be legal before being added, as the TT
+// entries can come from other positions with the same key.
 func GetPV(board dragontoothmg.Board, depth int) []dragontoothmg.Move {
 	pv := []dragontoothmg.Move{}
 	for i := 0; i < depth; i++ {
-		tt_entry, in_tt := GetTT(board.Hash())
-		if !in_tt || tt_entry.BestMove == 0 {
+		var move dragontoothmg.Move
+		if i < PVLength[0] {
+			move = PVTable[0][i]
+		} else {
+			tt_entry, in_tt := GetTT(board.Hash())
+			if !in_tt {
+				return pv
+			}
+			move = tt_entry.BestMove
+		}
+		if move == 0 || !slices.Contains(board.GenerateLegalMoves(), move) {
 			return pv
 		}
-		pv = append(pv, tt_entry.BestMove)
-		board.Apply(tt_entry.BestMove)
+		pv = append(pv, move)
+		board.Apply(move)
 	}
 	return pv
 }
@@ -708,6 +961,7 @@ func AspirationSearch(board dragontoothmg.Board, depth int, last_score int) (dra
 }
 
 func IterativeDeepening(board dragontoothmg.Board) dragontoothmg.Move {
+	WaitTTClear()
 	NodesSearched = 0     // reset the node counter
 	SearchStopped = false // reset the search interruption flag
 	var best_move dragontoothmg.Move
@@ -721,10 +975,14 @@ func IterativeDeepening(board dragontoothmg.Board) dragontoothmg.Move {
 	}
 
 	KillerMoves = [MAX_PLY][2]dragontoothmg.Move{} // Reset killer moves before the search
+	IncrementTTAge()
+	NMPMinPly = 0
+	clear(RootMoveNodes)
+	stability := 0 // Number of consecutive iterations with the same best move
 
 	var last_score int
 	if UseNNUE {
-		last_score = Network.GetEval(board.Wtomove)
+		last_score = Network.GetEval(&board)
 	} else {
 		last_score = Evaluate(&board)
 	}
@@ -737,9 +995,15 @@ func IterativeDeepening(board dragontoothmg.Board) dragontoothmg.Move {
 		t_start := time.Now()
 		move, score = AspirationSearch(board, depth, last_score)
 
+		score_drop := last_score - score
 		last_score = score
 
 		if move != 0 && !SearchStopped {
+			if move == best_move {
+				stability++
+			} else {
+				stability = 0
+			}
 			best_move = move
 		} else {
 			break // timeout before first move examined or search interrupted
@@ -753,14 +1017,29 @@ func IterativeDeepening(board dragontoothmg.Board) dragontoothmg.Move {
 			pv_str += move.String() + " "
 		}
 
-		fmt.Printf(
-			"info depth %v nodes %v nps %v score cp %v time %v pv %v\n",
-			depth, NodesSearched, nps, score, time.Since(SearchStart).Milliseconds(), pv_str,
-		)
+		score_str := fmt.Sprintf("cp %v", score)
+		if IsMateScore(score) {
+			score_str = fmt.Sprintf("mate %v", MateIn(score))
+		}
+
+		if PrintSearchInfo {
+			fmt.Printf(
+				"info depth %v nodes %v nps %v score %v time %v pv %v\n",
+				depth, NodesSearched, nps, score_str, time.Since(SearchStart).Milliseconds(), pv_str,
+			)
+		}
+
+		// The first iterations are too unstable to scale the time limit
+		soft_limit := SoftTimeLimit
+		if DynamicTimeLimit && depth >= 6 {
+			best_move_nodes := RootMoveNodes[best_move]
+			soft_limit = ScaledSoftTimeLimit(stability, score_drop, float64(best_move_nodes)/float64(max(1, NodesSearched)))
+		}
 
-		if time.Since(SearchStart).Seconds()+time.Since(t_start).Seconds() >= SoftTimeLimit ||
-			depth >= 50 ||
-			IsMateScore(score) {
+		// Once a mate is found, there is no need to search deeper than its distance
+		if time.Since(SearchStart).Seconds()+time.Since(t_start).Seconds() >= soft_limit ||
+			depth >= MaxSearchDepth ||
+			(IsMateScore(score) && depth >= MATE_SCORE-abs(score)) {
 			break
 		}
 
@@ -771,3 +1050,33 @@ func IterativeDeepening(board dragontoothmg.Board) dragontoothmg.Move {
 
 	return best_move
 }
+
+// Returns the move to play, without searching when there is a single legal move, or when the time is critically
+// short and the TT has a move for this position. The search result is checked, so that a legal move is always returned.
+func SearchBestMove(board dragontoothmg.Board) dragontoothmg.Move {
+	legal_moves := board.GenerateLegalMoves()
+	if len(legal_moves) == 0 {
+		return 0 // checkmate or stalemate (printed as bestmove 0000)
+	} else if len(legal_moves) == 1 {
+		return legal_moves[0]
+	}
+
+	WaitTTClear()
+	tt_move := dragontoothmg.Move(0)
+	if tt_entry, in_tt := GetTT(board.Hash()); in_tt && slices.Contains(legal_moves, tt_entry.BestMove) {
+		tt_move = tt_entry.BestMove
+	}
+	if CriticalTime && tt_move != 0 {
+		return tt_move
+	}
+
+	best_move := IterativeDeepening(board)
+	if best_move == 0 || !slices.Contains(legal_moves, best_move) {
+		// The search was stopped before completing the first iteration
+		if tt_move != 0 {
+			return tt_move
+		}
+		return legal_moves[0]
+	}
+	return best_move
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"math/bits"
+
+	"github.com/dylhunn/dragontoothmg"
+)
+
+// Static Exchange Evaluation (SEE)
+
+var SEE_VALUES = [7]int{0, 100, 300, 300, 500, 900, 0} // indexed by dragontoothmg piece type
+
+var KnightAttacks [64]uint64
+var KingAttacks [64]uint64
+var PawnAttacks [2][64]uint64 // Squares attacked by a pawn of each color
+
+func InitAttackTables() {
+	for square := 0; square < 64; square++ {
+		file := square % 8
+		rank := square / 8
+		KnightAttacks[square] = 0
+		KingAttacks[square] = 0
+		PawnAttacks[WHITE][square] = 0
+		PawnAttacks[BLACK][square] = 0
+		for _, offset := range [8][2]int{{1, 2}, {2, 1}, {2, -1}, {1, -2}, {-1, -2}, {-2, -1}, {-2, 1}, {-1, 2}} {
+			if f, r := file+offset[0], rank+offset[1]; f >= 0 && f < 8 && r >= 0 && r < 8 {
+				KnightAttacks[square] |= uint64(1) << (r*8 + f)
+			}
+		}
+		for _, offset := range [8][2]int{{1, 0}, {1, 1}, {0, 1}, {-1, 1}, {-1, 0}, {-1, -1}, {0, -1}, {1, -1}} {
+			if f, r := file+offset[0], rank+offset[1]; f >= 0 && f < 8 && r >= 0 && r < 8 {
+				KingAttacks[square] |= uint64(1) << (r*8 + f)
+			}
+		}
+		for _, f := range [2]int{file - 1, file + 1} {
+			if f < 0 || f >= 8 {
+				continue
+			}
+			if rank < 7 {
+				PawnAttacks[WHITE][square] |= uint64(1) << ((rank+1)*8 + f)
+			}
+			if rank > 0 {
+				PawnAttacks[BLACK][square] |= uint64(1) << ((rank-1)*8 + f)
+			}
+		}
+	}
+}
+
+// Returns all the pieces (of both colors) attacking a square, with a given occupancy
+func AttackersTo(board *dragontoothmg.Board, square uint8, occupied uint64) uint64 {
+	bishops := board.White.Bishops | board.Black.Bishops | board.White.Queens | board.Black.Queens
+	rooks := board.White.Rooks | board.Black.Rooks | board.White.Queens | board.Black.Queens
+	return (PawnAttacks[BLACK][square] & board.White.Pawns) |
+		(PawnAttacks[WHITE][square] & board.Black.Pawns) |
+		(KnightAttacks[square] & (board.White.Knights | board.Black.Knights)) |
+		(KingAttacks[square] & (board.White.Kings | board.Black.Kings)) |
+		(dragontoothmg.CalculateBishopMoveBitboard(square, occupied) & bishops) |
+		(dragontoothmg.CalculateRookMoveBitboard(square, occupied) & rooks)
+}
+
+// Checks whether the static exchange evaluation of a move is at least threshold
+// (pins are ignored, as well as promotions during the exchange)
+func SEE(board *dragontoothmg.Board, move dragontoothmg.Move, threshold int) bool {
+	from := move.From()
+	to := move.To()
+
+	victim, _ := dragontoothmg.GetPieceType(to, board)
+	attacker, _ := dragontoothmg.GetPieceType(from, board)
+	if victim == dragontoothmg.Nothing && attacker == dragontoothmg.Pawn && from%8 != to%8 {
+		victim = dragontoothmg.Pawn // en passant
+	}
+
+	swap := SEE_VALUES[victim] - threshold
+	if swap < 0 {
+		return false
+	}
+
+	swap = SEE_VALUES[attacker] - swap
+	if swap <= 0 {
+		return true
+	}
+
+	occupied := (board.White.All | board.Black.All) ^ (uint64(1) << from) ^ (uint64(1) << to)
+	attackers := AttackersTo(board, to, occupied)
+	bishops := board.White.Bishops | board.Black.Bishops | board.White.Queens | board.Black.Queens
+	rooks := board.White.Rooks | board.Black.Rooks | board.White.Queens | board.Black.Queens
+
+	white_to_move := board.Wtomove
+	result := true
+
+	for {
+		white_to_move = !white_to_move
+		attackers &= occupied
+
+		pieces := &board.White
+		if !white_to_move {
+			pieces = &board.Black
+		}
+		stm_attackers := attackers & pieces.All
+		if stm_attackers == 0 {
+			break
+		}
+
+		result = !result
+
+		// Find the least valuable attacker, and add the x-ray attackers behind it
+		var least_valuable uint64
+		var value int
+		if least_valuable = stm_attackers & pieces.Pawns; least_valuable != 0 {
+			value = SEE_VALUES[dragontoothmg.Pawn]
+		} else if least_valuable = stm_attackers & pieces.Knights; least_valuable != 0 {
+			value = SEE_VALUES[dragontoothmg.Knight]
+		} else if least_valuable = stm_attackers & pieces.Bishops; least_valuable != 0 {
+			value = SEE_VALUES[dragontoothmg.Bishop]
+		} else if least_valuable = stm_attackers & pieces.Rooks; least_valuable != 0 {
+			value = SEE_VALUES[dragontoothmg.Rook]
+		} else if least_valuable = stm_attackers & pieces.Queens; least_valuable != 0 {
+			value = SEE_VALUES[dragontoothmg.Queen]
+		} else {
+			// The king can only capture if the square isn't defended anymore
+			if attackers&^pieces.All != 0 {
+				return !result
+			}
+			return result
+		}
+
+		swap = value - swap
+		if swap < 0 || (swap == 0 && result) {
+			break
+		}
+
+		occupied ^= uint64(1) << bits.TrailingZeros64(least_valuable)
+		attackers |= dragontoothmg.CalculateBishopMoveBitboard(to, occupied) & bishops
+		attackers |= dragontoothmg.CalculateRookMoveBitboard(to, occupied) & rooks
+	}
+
+	return result
+}
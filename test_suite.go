@@ -311,6 +311,7 @@ r1b2rk1/p4ppp/1p1Qp3/4P2N/1P6/8/P3qPPP/3R1RK1 w - - 0 1:h5f6
 b2b1r1k/3R1ppp/4qP2/4p1PQ/4P3/5B2/4N1K1/8 w - - 0 1:g5g6`
 
 func RunTacticalTests() {
+	WaitTTClear()
 	scanner := bufio.NewScanner(strings.NewReader(WAC_TESTS))
 	num_correct := 0
 	total_pos := 0
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"math"
+
+	"github.com/dylhunn/dragontoothmg"
+)
+
+// Time management
+
+var MoveOverhead int = 30 // Time (in ms) kept in reserve for each move, to compensate for GUI/network latency
+
+const MAX_MOVE_OVERHEAD int = 5000
+
+// Whether the soft time limit can be scaled during the search (only with a clock, not with movetime)
+var DynamicTimeLimit bool = false
+
+// Soft time limit scale factors, indexed by the number of iterations with the same best move
+var STABILITY_FACTORS = [5]float64{2.5, 1.2, 0.9, 0.8, 0.75}
+
+// Number of nodes spent on each root move (indexed by the move, so that promotions to different pieces are distinct)
+var RootMoveNodes = map[dragontoothmg.Move]int{}
+
+var NodeLimit int = 0 // Maximum number of nodes of the search (0 if there is no limit)
+
+// Low time mode, to avoid losing on time in bullet games
+
+const LOW_TIME = 1000           // Below this remaining time (in ms), the engine switches to low time mode
+const CRITICAL_TIME = 50        // Below this remaining time (in ms, after the move overhead), the TT move is played without searching
+const LOW_TIME_MAX_DEPTH = 12   // Maximum search depth in low time mode
+const DEFAULT_MAX_DEPTH = 50    // Maximum search depth otherwise
+const LOW_TIME_CHECK_MASK = 63  // The time is checked every 64 nodes in low time mode...
+const DEFAULT_CHECK_MASK = 4095 // ...and every 4096 nodes otherwise
+
+var TimeCheckMask int = DEFAULT_CHECK_MASK
+var MaxSearchDepth int = DEFAULT_MAX_DEPTH
+var CriticalTime bool = false
+
+func SetLowTimeMode(time_left float64) {
+	if time_left < LOW_TIME {
+		TimeCheckMask = LOW_TIME_CHECK_MASK
+		MaxSearchDepth = LOW_TIME_MAX_DEPTH
+	} else {
+		TimeCheckMask = DEFAULT_CHECK_MASK
+		MaxSearchDepth = DEFAULT_MAX_DEPTH
+	}
+	CriticalTime = time_left-float64(MoveOverhead) < CRITICAL_TIME
+	if CriticalTime {
+		MaxSearchDepth = 1 // if there is no TT move, a quick search is still better than a random move
+	}
+}
+
+// Sets the time limits (in seconds) from the remaining time, increment (in ms) and the number
+// of moves to the next time control (0 if unknown)
+func SetTimeLimits(time_left float64, increment float64, moves_to_go int) {
+	SetLowTimeMode(time_left)
+	time_left = max(1, time_left-float64(MoveOverhead))
+
+	moves_left := 40.0
+	hard_divisor := 5.0
+	if moves_to_go > 0 {
+		moves_left = min(float64(moves_to_go), 40)
+		hard_divisor = max(2, min(float64(moves_to_go)+1, 5))
+	}
+
+	SoftTimeLimit = max(min(time_left/moves_left+increment*0.75, time_left/2-1000), 20)
+	HardTimeLimit = min(4*SoftTimeLimit, time_left/hard_divisor+increment*0.8)
+	SoftTimeLimit = min(SoftTimeLimit, HardTimeLimit)
+
+	SoftTimeLimit /= 1000 // convert to seconds
+	HardTimeLimit /= 1000
+	DynamicTimeLimit = true
+}
+
+// Sets the time limits (in seconds) for a fixed time per move (in ms)
+func SetMoveTime(move_time float64) {
+	SetLowTimeMode(move_time)
+	CriticalTime = false // the whole time can be used
+	MaxSearchDepth = max(MaxSearchDepth, LOW_TIME_MAX_DEPTH)
+	move_time = max(1, move_time-float64(MoveOverhead))
+	HardTimeLimit = move_time / 1000
+	SoftTimeLimit = (2 * move_time) / 3 / 1000
+	DynamicTimeLimit = false
+}
+
+// Removes all the limits of the search (before setting the limits of a new search)
+func ResetSearchLimits() {
+	SetLowTimeMode(math.Inf(1))
+	HardTimeLimit = math.Inf(1)
+	SoftTimeLimit = math.Inf(1)
+	DynamicTimeLimit = false
+	NodeLimit = 0
+}
+
+// Scales the soft time limit with:
+//   - the stability of the best move (number of iterations with the same best move)
+//   - the score drop since the last iteration (we need more time if the score is getting worse)
+//   - the fraction of nodes spent on the best move (if the best move took most nodes, the other moves
+//     were easily refuted so we can stop earlier)
+func ScaledSoftTimeLimit(stability int, score_drop int, best_move_nodes_fraction float64) float64 {
+	stability_factor := STABILITY_FACTORS[min(stability, len(STABILITY_FACTORS)-1)]
+	score_factor := max(0.8, min(1.5, 1+float64(score_drop)/100))
+	nodes_factor := max(0.5, min(2, (1.5-best_move_nodes_fraction)*1.35))
+	return min(SoftTimeLimit*stability_factor*score_factor*nodes_factor, HardTimeLimit)
+}
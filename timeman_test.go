@@ -0,0 +1,60 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/dylhunn/dragontoothmg"
+)
+
+// Plays games against itself with sub-second clocks (as in bullet games), and checks that the best move
+// is always legal and returned before the remaining time runs out
+func TestLowTimeNoFlag(t *testing.T) {
+	if testing.Short() || RACE_ENABLED {
+		t.Skip("self-play games with real clocks")
+	}
+	const max_plies = 30
+	clocks := [][2]float64{{100, 0}, {200, 0}, {100, 10}}
+
+	InitEngine()
+	PrintSearchInfo = false
+	defer func() {
+		PrintSearchInfo = true
+		HashHistory = HashHistory[:0]
+	}()
+
+	for _, clock := range clocks {
+		ClearTT()
+		WaitTTClear() // as after isready
+		HistoryTable = [2][64][64]int{}
+		ClearCorrectionHistory()
+		board := dragontoothmg.ParseFen(dragontoothmg.Startpos)
+		HashHistory = HashHistory[:0]
+		time_left := [2]float64{clock[0], clock[0]}
+
+		for plies := 0; plies < max_plies; plies++ {
+			legal_moves := board.GenerateLegalMoves()
+			if len(legal_moves) == 0 || IsRepetition(&board, 0) || board.Halfmoveclock >= 100 {
+				break
+			}
+			stm := GetColor(board.Wtomove)
+
+			start := time.Now()
+			SetTimeLimits(time_left[stm], clock[1], 0)
+			move := SearchBestMove(board)
+			used := float64(time.Since(start).Microseconds()) / 1000
+
+			if move == 0 || !slices.Contains(legal_moves, move) {
+				t.Fatalf("%v+%v ms: illegal move %v in position %v", clock[0], clock[1], move.String(), board.ToFen())
+			}
+			time_left[stm] -= used
+			if time_left[stm] <= 0 {
+				t.Fatalf("%v+%v ms: flagged after %v plies (%.1f ms used for the last move, in position %v)",
+					clock[0], clock[1], plies, used, board.ToFen())
+			}
+			time_left[stm] += clock[1]
+			PlayGameMove(&board, move)
+		}
+	}
+}
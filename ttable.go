@@ -1,6 +1,16 @@
 package main
 
 import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"unsafe"
 
 	"github.com/dylhunn/dragontoothmg"
@@ -14,49 +24,282 @@ const (
 	Upper
 )
 
+// Transposition table entry, as returned by GetTT
 type TTEntry struct {
-	Hash     uint64
 	BestMove dragontoothmg.Move
 	Score    int
+	Eval     int // Raw static eval of the position (NO_EVAL if in check)
 	Depth    int
 	Bound    Bound
+	Age      uint8 // Value of TTAge when the entry was stored
 }
 
-func NewTTEntry(hash uint64, best_move dragontoothmg.Move, score int, depth int, bound Bound) TTEntry {
+// Transposition table entry, as stored in the table (16 bytes)
+// All the data is packed in a single word, and the key is the hash XORed with the data, so that
+// an entry written concurrently by two threads (with the key of one and the data of the other) is
+// detected as invalid when probing, without needing any lock (lockless hashing, as in Crafty).
+type PackedTTEntry struct {
+	Key  atomic.Uint64 // hash ^ data
+	Data atomic.Uint64 // Best move (16 bits), score (16), eval (16), depth (8), bound (2) and age (6)
+}
+
+// The score and the eval are clamped so that they fit in 16 bits (a loaded network can give evals out of this range)
+func PackTTData(best_move dragontoothmg.Move, score int, eval int, depth int, bound Bound) uint64 {
+	score = max(-MATE_SCORE, min(MATE_SCORE, score))
+	if eval != NO_EVAL {
+		eval = max(-MATE_SCORE+MAX_PLY+1, min(MATE_SCORE-MAX_PLY-1, eval))
+	}
+	return uint64(best_move) |
+		uint64(uint16(int16(score)))<<16 |
+		uint64(uint16(int16(eval)))<<32 |
+		uint64(uint8(depth))<<48 |
+		uint64(uint8(bound)|TTAge<<2)<<56
+}
+
+func UnpackTTData(data uint64) TTEntry {
 	return TTEntry{
-		Hash:     hash,
-		BestMove: best_move,
-		Score:    score,
-		Depth:    depth,
-		Bound:    bound,
+		BestMove: dragontoothmg.Move(data),
+		Score:    int(int16(data >> 16)),
+		Eval:     int(int16(data >> 32)),
+		Depth:    int(uint8(data >> 48)),
+		Bound:    Bound((data >> 56) & 3),
+		Age:      uint8(data >> 58),
 	}
 }
 
+// Loads an entry, returning whether it is valid and belongs to this hash
+func (e *PackedTTEntry) Load(hash uint64) (TTEntry, bool) {
+	data := e.Data.Load()
+	key := e.Key.Load()
+	entry := UnpackTTData(data)
+	return entry, key^data == hash && entry.Depth != 0
+}
+
+func (e *PackedTTEntry) Store(hash uint64, data uint64) {
+	e.Data.Store(data)
+	e.Key.Store(hash ^ data)
+}
+
+// Number of entries per bucket: a position can be stored in any entry of its bucket
+const TT_BUCKET_SIZE = 4
+
+type TTBucket struct {
+	Entries [TT_BUCKET_SIZE]PackedTTEntry // 64 bytes: a bucket fits exactly in a cache line
+}
+
 var MAX_TT_ENTRIES int
 
 const DEFAULT_TT_SIZE int = 64
 
-var transposition_table []TTEntry
+const MAX_TT_SIZE int = 1 << 16 // 64 GB
+
+var TTSizeMB int // Current size of the table (in MB)
+
+var transposition_table []TTBucket
+
+var TTClearWaitGroup sync.WaitGroup
 
+// Generation counter (on 6 bits), incremented at each new search, so that entries from previous searches can be replaced first
+var TTAge uint8 = 0
+
+const TT_AGE_MASK = 63
+
+// Clears the table in the background, in parallel across goroutines (one per CPU).
+// WaitTTClear must be called before using the table again.
 func ClearTT() {
-	transposition_table = make([]TTEntry, MAX_TT_ENTRIES)
+	WaitTTClear()
+	TTAge = 0
+	num_threads := runtime.NumCPU()
+	chunk_size := (len(transposition_table) + num_threads - 1) / num_threads
+	for start := 0; start < len(transposition_table); start += chunk_size {
+		chunk := transposition_table[start:min(start+chunk_size, len(transposition_table))]
+		TTClearWaitGroup.Add(1)
+		go func() {
+			defer TTClearWaitGroup.Done()
+			clear(chunk)
+		}()
+	}
+}
+
+func WaitTTClear() {
+	TTClearWaitGroup.Wait()
+}
+
+func IncrementTTAge() {
+	TTAge = (TTAge + 1) & TT_AGE_MASK
+}
+
+// Number of searches since the entry was stored
+func (e *TTEntry) RelativeAge() int {
+	return int((TTAge - e.Age) & TT_AGE_MASK)
+}
+
+// Value of an entry for the replacement scheme: empty, shallow and old entries are replaced first
+func (e *TTEntry) ReplaceValue() int {
+	if e.Depth == 0 {
+		return -1 << 30
+	}
+	return e.Depth - 4*e.RelativeAge()
+}
+
+// The bucket index is computed with a multiply-shift (the upper 64 bits of hash * number of buckets),
+// so that the number of buckets doesn't have to be a power of two
+func GetBucket(hash uint64) *TTBucket {
+	index, _ := bits.Mul64(hash, uint64(len(transposition_table)))
+	return &transposition_table[index]
 }
 
-func StoreTT(hash uint64, best_move dragontoothmg.Move, score int, depth int, bound Bound) {
-	idx := hash & uint64(len(transposition_table)-1)
-	transposition_table[idx] = NewTTEntry(hash, best_move, score, depth, bound)
+func StoreTT(hash uint64, best_move dragontoothmg.Move, score int, eval int, depth int, bound Bound) {
+	bucket := GetBucket(hash)
+
+	// Find the entry to replace: the one of the same position if there is one, otherwise the
+	// least valuable one, preferring shallow entries and old entries from previous searches
+	var replaced *PackedTTEntry
+	var replaced_entry TTEntry
+	same_position := false
+	for i := range bucket.Entries {
+		entry, valid := bucket.Entries[i].Load(hash)
+		if valid {
+			replaced, replaced_entry, same_position = &bucket.Entries[i], entry, true
+			break
+		}
+		if replaced == nil || entry.ReplaceValue() < replaced_entry.ReplaceValue() {
+			replaced, replaced_entry = &bucket.Entries[i], entry
+		}
+	}
+
+	if same_position {
+		// Keep deeper results of the same search, unless we now have an exact score
+		if bound != Exact && depth+3 < replaced_entry.Depth && replaced_entry.RelativeAge() == 0 {
+			return
+		}
+		if best_move == 0 {
+			best_move = replaced_entry.BestMove
+		}
+	}
+
+	replaced.Store(hash, PackTTData(best_move, score, eval, depth, bound))
 }
 
-func GetTT(hash uint64) (*TTEntry, bool) {
-	entry := &transposition_table[hash&uint64(len(transposition_table)-1)]
-	return entry, entry.Hash == hash && entry.Depth != 0
+func GetTT(hash uint64) (TTEntry, bool) {
+	bucket := GetBucket(hash)
+	for i := range bucket.Entries {
+		if entry, valid := bucket.Entries[i].Load(hash); valid {
+			return entry, true
+		}
+	}
+	return TTEntry{}, false
 }
 
 func SetTTSize(size_in_mb int) {
-	entry_size := int(unsafe.Sizeof(TTEntry{}))
-	MAX_TT_ENTRIES = 1
-	for MAX_TT_ENTRIES*2*entry_size <= size_in_mb*(1<<20) {
-		MAX_TT_ENTRIES <<= 1
+	WaitTTClear()
+	size_in_mb = max(1, min(MAX_TT_SIZE, size_in_mb))
+	bucket_size := int(unsafe.Sizeof(TTBucket{}))
+	num_buckets := max(1, size_in_mb*(1<<20)/bucket_size)
+	if num_buckets == len(transposition_table) {
+		ClearTT()
+		WaitTTClear()
+		return
+	}
+	TTSizeMB = size_in_mb
+	MAX_TT_ENTRIES = num_buckets * TT_BUCKET_SIZE
+	transposition_table = nil // release the old table before allocating the new one
+	transposition_table = make([]TTBucket, num_buckets)
+	TTAge = 0
+}
+
+// Saving and loading the table to a file (to keep the results of long analysis sessions)
+
+const TT_FILE_MAGIC = "SXTT"
+const TT_FILE_VERSION = 1
+
+// Header of a saved table, followed by all the entries as (key, data) little-endian uint64 pairs
+type TTFileHeader struct {
+	Magic      [4]byte
+	Version    uint32
+	EntrySize  uint32
+	BucketSize uint32
+	NumBuckets uint64
+	SizeMB     uint32
+	Age        uint32
+}
+
+func SaveTT(filename string) error {
+	WaitTTClear()
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	writer := bufio.NewWriter(file)
+
+	header := TTFileHeader{
+		Version:    TT_FILE_VERSION,
+		EntrySize:  uint32(unsafe.Sizeof(PackedTTEntry{})),
+		BucketSize: TT_BUCKET_SIZE,
+		NumBuckets: uint64(len(transposition_table)),
+		SizeMB:     uint32(TTSizeMB),
+		Age:        uint32(TTAge),
+	}
+	copy(header.Magic[:], TT_FILE_MAGIC)
+	if err := binary.Write(writer, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+
+	buffer := make([]byte, 16*TT_BUCKET_SIZE)
+	for i := range transposition_table {
+		for j := range transposition_table[i].Entries {
+			entry := &transposition_table[i].Entries[j]
+			binary.LittleEndian.PutUint64(buffer[16*j:], entry.Key.Load())
+			binary.LittleEndian.PutUint64(buffer[16*j+8:], entry.Data.Load())
+		}
+		if _, err := writer.Write(buffer); err != nil {
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// Loads a table saved with SaveTT, which must have been saved with the same format and Hash size
+func LoadTT(filename string) error {
+	WaitTTClear()
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+
+	var header TTFileHeader
+	if err := binary.Read(reader, binary.LittleEndian, &header); err != nil {
+		return errors.New("invalid hash file header")
+	}
+	if string(header.Magic[:]) != TT_FILE_MAGIC {
+		return errors.New("not a hash file")
+	}
+	if header.Version != TT_FILE_VERSION || header.EntrySize != uint32(unsafe.Sizeof(PackedTTEntry{})) ||
+		header.BucketSize != TT_BUCKET_SIZE {
+		return fmt.Errorf("incompatible hash file format (version %v)", header.Version)
+	}
+	if header.NumBuckets != uint64(len(transposition_table)) {
+		return fmt.Errorf("hash file was saved with Hash %v MB, but Hash is %v MB", header.SizeMB, TTSizeMB)
+	}
+
+	buffer := make([]byte, 16*TT_BUCKET_SIZE)
+	for i := range transposition_table {
+		if _, err := io.ReadFull(reader, buffer); err != nil {
+			ClearTT() // don't keep a partially loaded table
+			return errors.New("truncated hash file")
+		}
+		for j := range transposition_table[i].Entries {
+			entry := &transposition_table[i].Entries[j]
+			entry.Key.Store(binary.LittleEndian.Uint64(buffer[16*j:]))
+			entry.Data.Store(binary.LittleEndian.Uint64(buffer[16*j+8:]))
+		}
 	}
-	transposition_table = make([]TTEntry, MAX_TT_ENTRIES)
+	TTAge = uint8(header.Age) & TT_AGE_MASK
+	return nil
 }
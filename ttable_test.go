@@ -0,0 +1,56 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dylhunn/dragontoothmg"
+)
+
+// Hammers the transposition table with concurrent stores and probes, and checks that every hit returns
+// the data which was stored for this hash (and not a torn entry mixing two writes).
+// Should also be run with the race detector: `go test -race -run TestTTConcurrentStress`
+func TestTTConcurrentStress(t *testing.T) {
+	const num_goroutines = 8
+	const num_operations = 200000
+	const num_hashes = 4096 // few hashes for a small table, to have a lot of collisions
+
+	SetTTSize(1)
+	defer SetTTSize(DEFAULT_TT_SIZE)
+
+	var wait_group sync.WaitGroup
+	var num_hits, num_errors atomic.Int64
+	for g := 0; g < num_goroutines; g++ {
+		wait_group.Add(1)
+		go func(seed int64) {
+			defer wait_group.Done()
+			rng := rand.New(rand.NewSource(seed))
+			for i := 0; i < num_operations; i++ {
+				hash := rng.Uint64()%num_hashes*0x9E3779B97F4A7C15 + 1
+				// All the data is derived from the hash, so that it can be checked when probing
+				move := dragontoothmg.Move(hash >> 48)
+				score := int(hash%2000) - 1000
+				depth := int(hash%60) + 1
+				if rng.Intn(2) == 0 {
+					StoreTT(hash, move, score, -score, depth, Bound(hash%3))
+				} else if entry, in_tt := GetTT(hash); in_tt {
+					num_hits.Add(1)
+					if entry.BestMove != move || entry.Score != score || entry.Eval != -score ||
+						entry.Depth != depth || entry.Bound != Bound(hash%3) {
+						num_errors.Add(1)
+					}
+				}
+			}
+		}(int64(g))
+	}
+	wait_group.Wait()
+
+	if num_hits.Load() == 0 {
+		t.Fatalf("no TT hits in %v probes", num_goroutines*num_operations/2)
+	}
+	if num_errors.Load() != 0 {
+		t.Fatalf("%v corrupted entries in %v hits", num_errors.Load(), num_hits.Load())
+	}
+}
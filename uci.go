@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"fmt"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 
@@ -12,19 +13,42 @@ import (
 
 var UseNNUE bool = true
 
-func LaunchUCI() {
-	var input string
-	game := dragontoothmg.ParseFen(dragontoothmg.Startpos)
+var HashFile string = "" // File used to save and load the transposition table
+
+var EvalFile string = "" // Network file, the embedded network is used if empty
+
+// Loads the network from EvalFile, falling back to the embedded network if it can't be loaded
+func LoadNetwork() {
+	if EvalFile != "" {
+		err := Network.LoadFile(EvalFile)
+		if err == nil {
+			fmt.Println("info string loaded network", EvalFile)
+			ResizeAccumStack(Network.HiddenSize)
+			return
+		}
+		fmt.Println("info string could not load network", EvalFile+":", err, "- using the embedded network")
+	}
 	Network.Load()
+	ResizeAccumStack(Network.HiddenSize)
+}
 
-	// Initialisation
+// Loads the network and initialises the tables used by the search
+func InitEngine() {
+	LoadNetwork()
 	InitIndexTable()
 	InitLMReductionTable()
+	InitCuckooTables()
+	InitAttackTables()
 	SetTTSize(DEFAULT_TT_SIZE)
+}
+
+func LaunchUCI() {
+	var input string
+	game := dragontoothmg.ParseFen(dragontoothmg.Startpos)
+	InitEngine()
 
 	scanner := bufio.NewScanner(os.Stdin)
-	for {
-		scanner.Scan()
+	for scanner.Scan() { // stops at the end of the input (e.g. if the GUI or the datagen process is gone)
 		input = scanner.Text()
 
 		input_split := strings.Fields(input)
@@ -34,86 +58,143 @@ func LaunchUCI() {
 		if input == "uci" {
 			fmt.Println("id name Simplex")
 			fmt.Println("option name Use NNUE type check default true")
-			fmt.Println("option name Hash type spin default", DEFAULT_TT_SIZE, "min 1 max 1024")
+			fmt.Println("option name Hash type spin default", DEFAULT_TT_SIZE, "min 1 max", MAX_TT_SIZE)
+			fmt.Println("option name Clear Hash type button")
+			fmt.Println("option name HashFile type string default <empty>")
+			fmt.Println("option name Save Hash type button")
+			fmt.Println("option name Load Hash type button")
+			fmt.Println("option name EvalFile type string default <empty>")
+			fmt.Println("option name Move Overhead type spin default", MoveOverhead, "min 0 max", MAX_MOVE_OVERHEAD)
+			fmt.Println("option name Debug NNUE type check default false")
 			fmt.Println("uciok")
 		} else if input == "isready" {
+			WaitTTClear()
 			fmt.Println("readyok")
 		} else if input == "ucinewgame" {
 			game = dragontoothmg.ParseFen(dragontoothmg.Startpos)
 			ClearTT()
 			HistoryTable = [2][64][64]int{} // reset the history table
+			ClearCorrectionHistory()
+			HashHistory = HashHistory[:0]
 			ResetAccumStack()
 		} else if strings.HasPrefix(input, "position") {
-			oldUseNNUE := UseNNUE
-			UseNNUE = false // disable NNUE updates while pushing moves
 			if input_split[1] == "startpos" {
 				game = dragontoothmg.ParseFen(dragontoothmg.Startpos)
-				RepetitionTable = map[int]int{}
+				HashHistory = HashHistory[:0]
 				if len(input_split) > 2 && input_split[2] == "moves" {
 					for _, move_str := range input_split[3:] {
 						move, _ := dragontoothmg.ParseMove(move_str)
-						PushMove(&game, move)
+						PlayGameMove(&game, move)
 					}
 				}
 			} else if input_split[1] == "fen" {
 				game = dragontoothmg.ParseFen(strings.Join(input_split[2:8], " "))
-				RepetitionTable = map[int]int{}
+				HashHistory = HashHistory[:0]
 				if len(input_split) > 8 && input_split[8] == "moves" {
 					for _, move_str := range input_split[9:] {
 						move, _ := dragontoothmg.ParseMove(move_str)
-						PushMove(&game, move)
+						PlayGameMove(&game, move)
 					}
 				}
 			}
-			UseNNUE = oldUseNNUE
 			Network.SetPosition(&game)
 		} else if strings.HasPrefix(input, "go") {
-			if len(input_split) == 3 && input_split[1] == "movetime" {
-				movetime, _ := strconv.ParseFloat(input_split[2], 64)
-				HardTimeLimit = movetime
-				SoftTimeLimit = (2 * movetime) / 3
-			} else if len(input_split) == 5 && input_split[1] == "wtime" && input_split[3] == "btime" {
-				wtime, _ := strconv.ParseFloat(input_split[2], 64)
-				btime, _ := strconv.ParseFloat(input_split[4], 64)
-				if !game.Wtomove {
-					wtime = btime
+			ResetSearchLimits()
+			var wtime, btime, winc, binc, movetime float64
+			movestogo, nodes, depth := 0, 0, 0
+			for i := 1; i+1 < len(input_split); i++ {
+				value, err := strconv.ParseFloat(input_split[i+1], 64)
+				if err != nil {
+					continue
 				}
-				SoftTimeLimit = max(min(wtime/40, wtime/2-1000), 20)
-				HardTimeLimit = min(4*SoftTimeLimit, wtime/5)
-			} else if len(input_split) == 9 {
-				wtime, _ := strconv.ParseFloat(input_split[2], 64)
-				btime, _ := strconv.ParseFloat(input_split[4], 64)
-				winc, _ := strconv.ParseFloat(input_split[6], 64)
-				binc, _ := strconv.ParseFloat(input_split[8], 64)
-				if !game.Wtomove {
-					wtime = btime
-					winc = binc
+				switch input_split[i] {
+				case "wtime":
+					wtime = value
+				case "btime":
+					btime = value
+				case "winc":
+					winc = value
+				case "binc":
+					binc = value
+				case "movestogo":
+					movestogo = int(value)
+				case "movetime":
+					movetime = value
+				case "nodes":
+					nodes = int(value)
+				case "depth":
+					depth = int(value)
 				}
-				SoftTimeLimit = max(min(wtime/40+winc*0.75, wtime/2-1000), 20)
-				HardTimeLimit = min(4*SoftTimeLimit, wtime/5+winc*0.8)
 			}
-			SoftTimeLimit /= 1000 // convert to seconds
-			HardTimeLimit /= 1000
-			legal_moves := game.GenerateLegalMoves()
-			var best_move dragontoothmg.Move
-			if len(legal_moves) == 1 {
-				best_move = legal_moves[0]
-			} else {
-				best_move = IterativeDeepening(game)
+			if !game.Wtomove {
+				wtime = btime
+				winc = binc
+			}
+			if movetime > 0 {
+				SetMoveTime(movetime)
+			} else if wtime > 0 {
+				SetTimeLimits(wtime, winc, movestogo)
 			}
+			NodeLimit = nodes // a node limit can be combined with a time limit
+			if depth > 0 {
+				MaxSearchDepth = min(depth, MaxSearchDepth)
+			}
+			best_move := SearchBestMove(game)
 			fmt.Println("bestmove", best_move.String())
 		} else if input_single_space == "setoption name Use NNUE value false" {
 			UseNNUE = false
+			ClearTT() // the stored evals come from the other evaluation function
+			ClearCorrectionHistory()
 		} else if input_single_space == "setoption name Use NNUE value true" {
 			UseNNUE = true
+			ClearTT() // the stored evals come from the other evaluation function
+			ClearCorrectionHistory()
+		} else if input_single_space == "setoption name Clear Hash" {
+			ClearTT()
+		} else if input_single_space == "setoption name Save Hash" {
+			if HashFile == "" {
+				fmt.Println("info string no HashFile set")
+			} else if err := SaveTT(HashFile); err != nil {
+				fmt.Println("info string could not save hash:", err)
+			}
+		} else if input_single_space == "setoption name Load Hash" {
+			if HashFile == "" {
+				fmt.Println("info string no HashFile set")
+			} else if err := LoadTT(HashFile); err != nil {
+				fmt.Println("info string could not load hash:", err)
+			}
 		} else if strings.HasPrefix(input_single_space, "setoption name") {
-			name := input_split[2]
-			value := input_split[4]
+			// The name and the value can both contain spaces
+			value_index := slices.Index(input_split, "value")
+			if value_index < 0 {
+				continue
+			}
+			name := strings.Join(input_split[2:value_index], " ")
+			value := strings.Join(input_split[value_index+1:], " ")
 
 			switch name {
 			case "Hash":
 				hash_size, _ := strconv.Atoi(value)
 				SetTTSize(hash_size)
+			case "HashFile":
+				HashFile = value
+				if HashFile == "<empty>" {
+					HashFile = ""
+				}
+			case "EvalFile":
+				EvalFile = value
+				if EvalFile == "<empty>" {
+					EvalFile = ""
+				}
+				LoadNetwork()
+				Network.SetPosition(&game)
+				ClearTT() // the stored evals come from the previous network
+				ClearCorrectionHistory()
+			case "Move Overhead":
+				overhead, _ := strconv.Atoi(value)
+				MoveOverhead = max(0, min(MAX_MOVE_OVERHEAD, overhead))
+			case "Debug NNUE":
+				DebugNNUE = value == "true"
 			case "RFPMargin":
 				RFP_MARGIN, _ = strconv.Atoi(value)
 			case "RazorMargin":
@@ -130,6 +211,10 @@ func LaunchUCI() {
 			case "LMRDiv":
 				LMR_DIV, _ = strconv.ParseFloat(value, 64)
 				InitLMReductionTable()
+			case "NMPEvalDiv":
+				NMP_EVAL_DIV, _ = strconv.Atoi(value)
+			case "ProbCutMargin":
+				PROBCUT_MARGIN, _ = strconv.Atoi(value)
 			}
 		} else if input == "quit" {
 			break